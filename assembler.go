@@ -2,81 +2,512 @@ package gmachine
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 )
 
-func Assemble(input io.Reader) (program []Word, err error) {
-	data, err := io.ReadAll(input)
+func Assemble(input io.Reader) ([]Word, error) {
+	p, err := AssembleProgram(input)
 	if err != nil {
 		return nil, err
 	}
-	tokens, err := Tokenize(string(data))
+	return p.Words, nil
+}
+
+// AssembleProgram assembles the source read from input, like Assemble, but
+// also returns the addresses of the labels it defines.
+//
+// The source may be split into sections with the .text and .data
+// directives. Code in .text, which is the default, is placed from address 0,
+// and everything in .data is placed after it, so labels in either section
+// can be referred to from anywhere.
+func AssembleProgram(input io.Reader) (Program, error) {
+	return Assembler{}.Assemble(input)
+}
+
+// Assembler holds options which change how source is assembled. The zero
+// value assembles in the same way as AssembleProgram.
+type Assembler struct {
+	// MemSize, if nonzero, is the number of words of memory the program
+	// will be run with. Jump and load targets at or beyond it are
+	// reported as errors.
+	MemSize int
+
+	// Origin is the address at which the program will be loaded. Labels
+	// and current address expressions resolve relative to it.
+	Origin Word
+
+	// Align, if greater than 1, pads the .text section with NOOPs so that
+	// every instruction in it starts at an address which is a multiple of
+	// Align. Labels on a padded instruction point to the instruction, not
+	// the padding.
+	Align int
+}
+
+// Assemble assembles the source read from input using the options in a.
+func (a Assembler) Assemble(input io.Reader) (Program, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return Program{}, err
+	}
+	start := time.Now()
+	tokens, err := tokenizeSource("", string(data), nil)
+	if err != nil {
+		return Program{}, err
+	}
+	return a.assemble(tokens, start)
+}
+
+// AssembleFiles assembles the named files as a single program, placing the
+// code from each file after that of the file before it. Labels are shared
+// between the files, so code in one file may refer to labels defined in
+// another, but a label may only be defined once across all of them.
+func (a Assembler) AssembleFiles(filenames ...string) (Program, error) {
+	var sources []string
+	for _, filename := range filenames {
+		data, err := readSource(filename)
+		if err != nil {
+			return Program{}, err
+		}
+		sources = append(sources, string(data))
+	}
+	start := time.Now()
+	var tokens []Token
+	for i, source := range sources {
+		fileTokens, err := tokenizeSource(filenames[i], source, nil)
+		if err != nil {
+			return Program{}, err
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+	return a.assemble(tokens, start)
+}
+
+// tokenizeSource tokenizes src, which was read from the named file, or from
+// a reader if filename is empty. Each line of the form
+//
+//	#include "lib.g"
+//
+// is replaced by the tokens of the file it names, which is found relative
+// to the including file. including lists the files whose includes are
+// already being expanded, so that circular includes can be reported.
+func tokenizeSource(filename, src string, including []string) ([]Token, error) {
+	type include struct {
+		line     int
+		filename string
+	}
+	var includes []include
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "#include")
+		if !ok {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		quoted, err := strconv.QuotedPrefix(rest)
+		after := strings.TrimSpace(rest[len(quoted):])
+		if err != nil || (after != "" && !strings.HasPrefix(after, "//")) {
+			where := Token{File: filename, Line: i + 1, Col: strings.Index(line, "#")}.where()
+			return nil, fmt.Errorf("%s: #include needs a quoted file name", where)
+		}
+		name, _ := strconv.Unquote(quoted)
+		includes = append(includes, include{
+			line:     i + 1,
+			filename: filepath.Join(filepath.Dir(filename), name),
+		})
+		// The line is blanked rather than removed, so that the lines
+		// after it keep their numbers.
+		lines[i] = ""
+	}
+	tokens, err := Tokenize(strings.Join(lines, "\n"))
+	if err != nil {
+		if filename == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s:%w", filename, err)
+	}
+	for i := range tokens {
+		tokens[i].File = filename
+	}
+	var result []Token
+	for _, inc := range includes {
+		for len(tokens) > 0 && tokens[0].Line < inc.line {
+			result = append(result, tokens[0])
+			tokens = tokens[1:]
+		}
+		included, err := tokenizeFile(inc.filename, append(including, filename))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, included...)
+	}
+	return append(result, tokens...), nil
+}
+
+// tokenizeFile reads and tokenizes the named file, which is included from
+// the last of including, expanding its own includes.
+func tokenizeFile(filename string, including []string) ([]Token, error) {
+	for i, f := range including {
+		if filepath.Clean(f) == filepath.Clean(filename) {
+			cycle := append(append([]string{}, including[i:]...), filename)
+			return nil, fmt.Errorf("circular include: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	data, err := readSource(filename)
 	if err != nil {
 		return nil, err
 	}
-	argRequired := false
-	labelDefinitions := make(map[string]int)
-	labelReferences := make(map[string][]int)
+	return tokenizeSource(filename, string(data), including)
+}
+
+// assemble assembles tokens into a program, recording the time since start
+// as the assembly duration.
+func (a Assembler) assemble(tokens []Token, start time.Time) (Program, error) {
+	text, dataSection := &section{}, &section{data: true}
+	current := text
+	argsRequired := 0
+	labelDefinitions := make(map[string]address)
+	labelReferences := make(map[string][]address)
+	labelTokens := make(map[string]Token)
+	var labelOrder []string
+	firstReferences := make(map[string]Token)
+	// relativeTo maps the operands of relative jumps which refer to labels
+	// to the address of their instruction, from which the offset is taken.
+	relativeTo := make(map[address]address)
+	relative := false
+	constants := make(map[string]Word)
+	constTokens := make(map[string]Token)
+	var constToken Token
+	var constName string
+	inConst := false
+	var dataToken Token
+	dataWords := 0
+	inData := false
+	// inlineData counts the words .word directives emit into .text.
+	inlineData := 0
+	var fixups []fixup
+	var targets []target
+	wantTarget := false
+	// instructionToken is the last instruction read, whose arguments
+	// argsRequired counts down.
+	var instructionToken Token
 	for _, token := range tokens {
+		// Directives without a leading dot are also ordinary names, so
+		// where a name is expected they are taken as label references.
+		if token.Kind == TokenDirective && !strings.HasPrefix(token.RawToken, ".") &&
+			(argsRequired > 0 || inData || (inConst && constName == "")) {
+			token.Kind = TokenLabelReference
+		}
+		// A .const directive is followed by a name and a value, which are
+		// consumed here rather than assembled.
+		if inConst && token.Kind != TokenComment {
+			if constName == "" {
+				if token.Kind != TokenLabelReference {
+					return Program{}, fmt.Errorf("%s: .const needs a name, got %q", token.where(), token.RawToken)
+				}
+				if previous, ok := constTokens[token.RawToken]; ok {
+					return Program{}, fmt.Errorf("%s: constant %q already defined at %s", token.where(), token.RawToken, previous.where())
+				}
+				if previous, ok := labelTokens[token.RawToken]; ok {
+					return Program{}, fmt.Errorf("%s: constant %q already defined as a label at %s", token.where(), token.RawToken, previous.where())
+				}
+				constName = token.RawToken
+				continue
+			}
+			if token.Kind != TokenNumberLiteral && token.Kind != TokenRuneLiteral {
+				return Program{}, fmt.Errorf("%s: .const %s needs a number value, got %q", token.where(), constName, token.RawToken)
+			}
+			constants[constName] = token.Value
+			constTokens[constName] = constToken
+			constName, inConst = "", false
+			continue
+		}
+		// A .word directive is followed by the words to emit, up to the end
+		// of its line.
+		if inData && (token.Line != dataToken.Line || token.File != dataToken.File) {
+			if dataWords == 0 {
+				return Program{}, fmt.Errorf("%s: .word needs at least one value", dataToken.where())
+			}
+			inData = false
+		}
+		if inData {
+			switch token.Kind {
+			case TokenComment:
+			case TokenNumberLiteral, TokenRuneLiteral, TokenLabelReference, TokenCurrentAddress:
+				dataWords++
+				if current == text {
+					inlineData++
+				}
+			default:
+				return Program{}, fmt.Errorf("%s: unexpected %q in .word", token.where(), token.RawToken)
+			}
+		}
 		switch token.Kind {
 		case TokenComment:
 			continue
+		case TokenDirective:
+			if argsRequired > 0 {
+				return Program{}, fmt.Errorf("%s: unexpected directive %q", token.where(), token.RawToken)
+			}
+			switch strings.ToLower(token.RawToken) {
+			case ".text":
+				current = text
+			case ".data":
+				current = dataSection
+			case ".const", "const":
+				constToken, inConst = token, true
+			case ".word", "data":
+				dataToken, dataWords, inData = token, 0, true
+			}
+			continue
 		case TokenInstruction:
-			if argRequired {
-				return nil, fmt.Errorf("line %d: unexpected instruction %q", token.Line, token.RawToken)
+			if argsRequired > 0 {
+				return Program{}, fmt.Errorf("%s: unexpected instruction %q", token.where(), token.RawToken)
+			}
+			argsRequired = OpCode(token.Value).ArgCount()
+			instructionToken = token
+			if a.Align > 1 && !current.data {
+				a.pad(current, labelOrder, labelDefinitions)
 			}
-			argRequired = OpCode(token.Value).RequiresArgument()
+			current.instructionStart = len(current.words)
+			relative = OpCode(token.Value) == OpJMPR
+			switch OpCode(token.Value) {
+			case OpLDAI, OpSTIMM, OpSTAI:
+				wantTarget = true
+			default:
+				wantTarget = OpCode(token.Value).isJump()
+			}
+			current.words = append(current.words, token.Value)
+			continue
 		case TokenRuneLiteral, TokenNumberLiteral:
-			argRequired = false
+			argsRequired = max(argsRequired-1, 0)
+		case TokenCurrentAddress:
+			if relative && argsRequired > 0 {
+				relativeTo[current.here()] = address{data: current.data, offset: current.instructionStart}
+			}
+			argsRequired = max(argsRequired-1, 0)
+			fixups = append(fixups, fixup{
+				at:     current.here(),
+				target: address{data: current.data, offset: current.instructionStart},
+				addend: token.Value,
+			})
 		case TokenLabelReference:
-			argRequired = false
-			labelReferences[token.RawToken] = append(labelReferences[token.RawToken], len(program))
+			if relative && argsRequired > 0 {
+				relativeTo[current.here()] = address{data: current.data, offset: current.instructionStart}
+			}
+			argsRequired = max(argsRequired-1, 0)
+			if _, ok := firstReferences[token.RawToken]; !ok {
+				firstReferences[token.RawToken] = token
+			}
+			labelReferences[token.RawToken] = append(labelReferences[token.RawToken], current.here())
 		case TokenLabelDefinition:
-			argRequired = false
+			if argsRequired > 0 {
+				return Program{}, fmt.Errorf("%s: unexpected label definition %q", token.where(), token.RawToken)
+			}
 			label := strings.TrimSuffix(token.RawToken, ":")
-			labelDefinitions[label] = len(program)
+			if previous, ok := labelTokens[label]; ok {
+				return Program{}, fmt.Errorf("%s: label %q already defined at %s", token.where(), label, previous.where())
+			}
+			if previous, ok := constTokens[label]; ok {
+				return Program{}, fmt.Errorf("%s: label %q already defined as a constant at %s", token.where(), label, previous.where())
+			}
+			labelDefinitions[label] = current.here()
+			labelTokens[label] = token
+			labelOrder = append(labelOrder, label)
 			continue
 		default:
-			return nil, fmt.Errorf("line %d: unknown token kine %q", token.Line, token.Kind)
+			return Program{}, fmt.Errorf("%s: unknown token kine %q", token.where(), token.Kind)
+		}
+		if wantTarget {
+			targets = append(targets, target{at: current.here(), token: token})
+			wantTarget = false
 		}
-		program = append(program, token.Value)
+		current.words = append(current.words, token.Value)
+	}
+	if inConst {
+		return Program{}, fmt.Errorf("%s: incomplete .const definition", constToken.where())
+	}
+	if argsRequired > 0 {
+		return Program{}, fmt.Errorf("%s: missing argument to %q", instructionToken.where(), instructionToken.RawToken)
+	}
+	if inData && dataWords == 0 {
+		return Program{}, fmt.Errorf("%s: .word needs at least one value", dataToken.where())
+	}
+	// A program with no words, such as one containing only whitespace and
+	// separators, assembles to an empty rather than a nil slice.
+	program := make([]Word, 0, len(text.words)+len(dataSection.words))
+	program = append(program, text.words...)
+	program = append(program, dataSection.words...)
+	resolve := func(a address) int {
+		if a.data {
+			return len(text.words) + a.offset
+		}
+		return a.offset
+	}
+	labels := make(map[string]Word, len(labelDefinitions))
+	for label, definition := range labelDefinitions {
+		labels[label] = a.Origin + Word(resolve(definition))
 	}
 	for label, references := range labelReferences {
-		definition, ok := labelDefinitions[label]
+		definition, ok := labels[label]
+		value, isConst := constants[label]
+		if isConst {
+			definition, ok = value, true
+		}
 		if !ok {
-			return nil, fmt.Errorf("undefined label %q", label)
+			return Program{}, fmt.Errorf("%s: undefined label %q", firstReferences[label].where(), label)
 		}
 		for _, reference := range references {
-			program[reference] = Word(definition)
+			program[resolve(reference)] = definition
+			if from, ok := relativeTo[reference]; ok && !isConst {
+				program[resolve(reference)] = definition - a.Origin - Word(resolve(from))
+			}
+		}
+	}
+	for _, f := range fixups {
+		program[resolve(f.at)] = a.Origin + Word(resolve(f.target)) + f.addend
+		if from, ok := relativeTo[f.at]; ok {
+			program[resolve(f.at)] = Word(resolve(f.target)) + f.addend - Word(resolve(from))
+		}
+	}
+	if a.MemSize > 0 {
+		for _, t := range targets {
+			addr := program[resolve(t.at)]
+			if addr >= Word(a.MemSize) {
+				return Program{}, fmt.Errorf("%s: address %d exceeds memory size %d", t.token.where(), addr, a.MemSize)
+			}
+		}
+	}
+	var warnings []string
+	for _, label := range labelOrder {
+		if len(labelReferences[label]) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: label %q is never referenced", labelTokens[label].where(), label))
 		}
 	}
-	return program, nil
+	return Program{
+		Words:      program,
+		Labels:     labels,
+		CodeSize:   len(text.words),
+		inlineData: inlineData,
+		Warnings:   warnings,
+		Stats: AssemblyStats{
+			Tokens:   len(tokens),
+			Words:    len(program),
+			Duration: time.Since(start),
+		},
+	}, nil
+}
+
+// pad adds NOOPs to s until its next word is at a multiple of a.Align, moving
+// the labels defined at the old end of s to the new one.
+func (a Assembler) pad(s *section, labelOrder []string, labelDefinitions map[string]address) {
+	before := s.here()
+	for (int(a.Origin)+len(s.words))%a.Align != 0 {
+		s.words = append(s.words, Word(OpNOOP))
+	}
+	for i := len(labelOrder) - 1; i >= 0 && labelDefinitions[labelOrder[i]] == before; i-- {
+		labelDefinitions[labelOrder[i]] = s.here()
+	}
+}
+
+// section accumulates the words assembled into one section of a program.
+type section struct {
+	data             bool
+	words            []Word
+	instructionStart int
+}
+
+// here returns the address of the next word to be added to the section.
+func (s *section) here() address {
+	return address{data: s.data, offset: len(s.words)}
+}
+
+// address is the location of a word relative to the start of its section.
+type address struct {
+	data   bool
+	offset int
+}
+
+// target records an operand which is the address of a jump or load.
+type target struct {
+	at    address
+	token Token
+}
+
+// fixup records a word whose value is an address which is only known once
+// every section has been assembled.
+type fixup struct {
+	at     address
+	target address
+	addend Word
 }
 
 func AssembleFromFile(filename string) ([]Word, error) {
-	file, err := os.Open(filename)
+	p, err := AssembleProgramFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return p.Words, nil
+}
+
+// AssembleProgramFromFile is like AssembleFromFile, but returns the whole
+// assembled Program.
+func AssembleProgramFromFile(filename string) (Program, error) {
+	return Assembler{}.AssembleFiles(filename)
+}
+
+// readSource returns the contents of the named source file, decompressing
+// it first if it is gzipped.
+func readSource(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	program, err := Assemble(file)
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("%s:%w", filename, err)
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
-	return program, nil
+	data, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return data, nil
 }
 
 func Tokenize(data string) ([]Token, error) {
 	return NewTokenizer().Run(data)
 }
 
+// PrintTokens writes a table of tokens to w, giving the kind, raw text,
+// value, line and column of each.
+func PrintTokens(w io.Writer, tokens []Token) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tRAW\tVALUE\tLINE\tCOL")
+	for _, token := range tokens {
+		fmt.Fprintf(tw, "%s\t%q\t%d\t%d\t%d\n", kind[token.Kind], token.RawToken, token.Value, token.Line, token.Col)
+	}
+	return tw.Flush()
+}
+
+// DefaultMaxTokenLen is the maximum number of runes in a token accepted by a
+// new tokenizer.
+const DefaultMaxTokenLen = 1024
+
 func NewTokenizer() *tokenizer {
 	t := new(tokenizer)
 	t.line = 1
 	t.Log = new(bytes.Buffer)
+	t.MaxTokenLen = DefaultMaxTokenLen
 	return t
 }
 
@@ -84,8 +515,15 @@ type tokenizer struct {
 	input            []rune
 	Log              *bytes.Buffer
 	start, pos, line int
+	lineStart        int
 	result           []Token
 	err              error
+
+	// MaxTokenLen is the maximum number of runes in an identifier or
+	// number, or zero for no limit. Longer tokens are a syntax error,
+	// which stops pathological input from being scanned and parsed in
+	// full. Comments and string literals are not limited.
+	MaxTokenLen int
 }
 
 func (t *tokenizer) Run(data string) ([]Token, error) {
@@ -124,15 +562,38 @@ func (t *tokenizer) backup() {
 }
 
 func (t *tokenizer) emit() {
+	if t.err != nil {
+		return
+	}
 	token, err := newToken(t.input[t.start:t.pos])
 	if err != nil {
-		t.err = fmt.Errorf("%d: syntax error: %w", t.line, err)
+		t.syntaxError("%w", err)
 	}
 	token.Line = t.line
+	token.Col = t.col()
 	t.log("emit", token)
 	t.result = append(t.result, token)
 }
 
+// errorf records an error which stops tokenization, unless one has already
+// been recorded.
+func (t *tokenizer) errorf(format string, args ...interface{}) {
+	if t.err == nil {
+		t.err = fmt.Errorf(format, args...)
+	}
+}
+
+// syntaxError records a syntax error at the line and column of the current
+// token, like errorf.
+func (t *tokenizer) syntaxError(format string, args ...interface{}) {
+	t.errorf("%d:%d: syntax error: %w", t.line, t.col()+1, fmt.Errorf(format, args...))
+}
+
+// col returns the zero-based column at which the current token starts.
+func (t *tokenizer) col() int {
+	return t.start - t.lineStart
+}
+
 func (t *tokenizer) log(args ...interface{}) {
 	fmt.Fprintln(t.Log, args...)
 }
@@ -157,8 +618,9 @@ func wantToken(t *tokenizer) stateFunc {
 		switch t.next() {
 		case '\n':
 			t.line++
+			t.lineStart = t.pos
 			t.skip()
-		case ' ', ';':
+		case ' ', '\t', '\r', ';':
 			t.skip()
 		case eof:
 			return nil
@@ -177,9 +639,16 @@ func inToken(t *tokenizer) stateFunc {
 			if t.peek() == '/' {
 				return inComment
 			}
-			t.err = fmt.Errorf("%d: syntax error: expected '/' got '%c'", t.line, t.peek())
+			if t.peek() == '*' {
+				t.backup()
+				if t.pos > t.start {
+					t.emit()
+				}
+				return inBlockComment
+			}
+			t.syntaxError("expected '/' got '%c'", t.peek())
 			return nil
-		case '\n', ' ', ';':
+		case '\n', ' ', '\t', '\r', ';':
 			t.backup()
 			t.emit()
 			return wantToken
@@ -188,10 +657,16 @@ func inToken(t *tokenizer) stateFunc {
 			return wantToken
 		case '\'':
 			return inRuneLiteral
+		case '"':
+			return inStringLiteral
 		case eof:
 			t.emit()
 			return nil
 		}
+		if t.MaxTokenLen > 0 && t.pos-t.start > t.MaxTokenLen {
+			t.syntaxError("token too long")
+			return nil
+		}
 	}
 }
 
@@ -203,9 +678,90 @@ func inRuneLiteral(t *tokenizer) stateFunc {
 			t.emit()
 			return wantToken
 		case eof:
-			t.err = fmt.Errorf("unexpected EOF in rune literal")
+			t.errorf("unexpected EOF in rune literal")
+			return nil
+		}
+	}
+}
+
+func inStringLiteral(t *tokenizer) stateFunc {
+	for {
+		t.logState("inStringLiteral")
+		switch t.next() {
+		case '\\':
+			if t.next() == eof {
+				t.errorf("unexpected EOF in string literal")
+				return nil
+			}
+		case '"':
+			t.emitString()
+			return wantToken
+		case '\n':
+			t.syntaxError("newline in string literal")
+			return nil
+		case eof:
+			t.errorf("unexpected EOF in string literal")
+			return nil
+		}
+	}
+}
+
+// emitString emits a number literal token for each rune of the string
+// literal just read. The escapes \", \n and \\ stand for a double quote, a
+// newline and a backslash.
+func (t *tokenizer) emitString() {
+	raw := t.input[t.start:t.pos]
+	if raw[0] != '"' {
+		t.syntaxError("invalid string literal %q", string(raw))
+		return
+	}
+	escapes := map[rune]rune{'"': '"', 'n': '\n', '\\': '\\'}
+	for i := 1; i < len(raw)-1; i++ {
+		start := i
+		r := raw[i]
+		if r == '\\' {
+			i++
+			escaped, ok := escapes[raw[i]]
+			if !ok {
+				t.syntaxError("unknown escape sequence %q in string literal", string(raw[start:i+1]))
+				return
+			}
+			r = escaped
+		}
+		token := Token{
+			Kind:     TokenNumberLiteral,
+			Value:    Word(r),
+			RawToken: string(raw[start : i+1]),
+			Line:     t.line,
+			Col:      t.col() + start,
+		}
+		t.log("emit", token)
+		t.result = append(t.result, token)
+	}
+}
+
+// inBlockComment skips a /* ... */ comment. Unlike line comments, block
+// comments are not emitted as tokens, so they may be any length.
+func inBlockComment(t *tokenizer) stateFunc {
+	t.pos += 2
+	t.skip()
+	for {
+		t.logState("inBlockComment")
+		switch t.next() {
+		case '\n':
+			t.line++
+			t.lineStart = t.pos
+		case '*':
+			if t.peek() == '/' {
+				t.next()
+				t.skip()
+				return wantToken
+			}
+		case eof:
+			t.errorf("unexpected EOF in block comment")
 			return nil
 		}
+		t.skip()
 	}
 }
 
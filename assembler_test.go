@@ -1,7 +1,13 @@
 package gmachine_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"testing/iotest"
@@ -37,6 +43,441 @@ func TestLabels(t *testing.T) {
 	}
 }
 
+func TestLabelArguments(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		program string
+		want    []gmachine.Word
+	}
+	for _, c := range []testCase{
+		{
+			program: "JNEQ end; INCA; end: HALT",
+			want: []gmachine.Word{
+				gmachine.Word(gmachine.OpJNEQ), 3,
+				gmachine.Word(gmachine.OpINCA),
+				gmachine.Word(gmachine.OpHALT),
+			},
+		},
+		{
+			program: "SETI table; HALT; .data; table: 7",
+			want: []gmachine.Word{
+				gmachine.Word(gmachine.OpSETI), 3,
+				gmachine.Word(gmachine.OpHALT),
+				7,
+			},
+		},
+	} {
+		got, err := gmachine.Assemble(strings.NewReader(c.program))
+		if err != nil {
+			t.Fatalf("%s: %v", c.program, err)
+		}
+		if !cmp.Equal(c.want, got) {
+			t.Errorf("%s: %s", c.program, cmp.Diff(c.want, got))
+		}
+	}
+}
+
+func TestEveryArgumentCanBeALabel(t *testing.T) {
+	t.Parallel()
+	for op := gmachine.OpCode(0); op < 256; op++ {
+		if op.String() == "" || !op.RequiresArgument() {
+			continue
+		}
+		args := strings.Repeat(" target", op.ArgCount())
+		program := "NOOP\n" + op.String() + args + "\ntarget: HALT"
+		got, err := gmachine.Assemble(strings.NewReader(program))
+		if err != nil {
+			t.Errorf("%s: %v", op, err)
+			continue
+		}
+		target := gmachine.Word(2 + op.ArgCount())
+		if op == gmachine.OpJMPR {
+			// JMPR's argument is relative to its own address.
+			target--
+		}
+		for i := 1; i <= op.ArgCount(); i++ {
+			if got[1+i] != target {
+				t.Errorf("%s: want argument %d to be %d, got %d", op, i, target, got[1+i])
+			}
+		}
+	}
+}
+
+func TestUndefinedLabelArgumentReportsLine(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("NOOP\nSETI 1\nJNEQ nowhere\nHALT"))
+	if err == nil {
+		t.Fatal("want error for undefined label, got nil")
+	}
+	want := `3:6: undefined label "nowhere"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestCurrentAddress(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name    string
+		program string
+		want    []gmachine.Word
+	}
+	for _, c := range []testCase{
+		{
+			name:    "self loop",
+			program: "NOOP; JUMP $",
+			want:    []gmachine.Word{gmachine.Word(gmachine.OpNOOP), gmachine.Word(gmachine.OpJUMP), 1},
+		},
+		{
+			name:    "forward offset",
+			program: "NOOP; JUMP $+2; HALT",
+			want:    []gmachine.Word{gmachine.Word(gmachine.OpNOOP), gmachine.Word(gmachine.OpJUMP), 3, gmachine.Word(gmachine.OpHALT)},
+		},
+		{
+			name:    "relative self loop",
+			program: "NOOP; JMPR $; HALT",
+			want:    []gmachine.Word{gmachine.Word(gmachine.OpNOOP), gmachine.Word(gmachine.OpJMPR), 0, gmachine.Word(gmachine.OpHALT)},
+		},
+		{
+			name:    "relative forward offset",
+			program: "NOOP; JMPR $+3; INCA; HALT",
+			want:    []gmachine.Word{gmachine.Word(gmachine.OpNOOP), gmachine.Word(gmachine.OpJMPR), 3, gmachine.Word(gmachine.OpINCA), gmachine.Word(gmachine.OpHALT)},
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := gmachine.Assemble(strings.NewReader(c.program))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(c.want, got) {
+				t.Error(cmp.Diff(c.want, got))
+			}
+		})
+	}
+}
+
+func TestCurrentAddressSkipsInstruction(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "JUMP $+3; INCA; HALT")
+	var want gmachine.Word = 0
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestCurrentAddressRelativeJumpSkipsInstruction(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "NOOP; JMPR $+3; INCA; HALT")
+	var want gmachine.Word = 0
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestInvalidCurrentAddressError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("JUMP $x"))
+	if err == nil {
+		t.Error("want error for invalid current address expression, got nil")
+	}
+}
+
+func TestSections(t *testing.T) {
+	t.Parallel()
+	program := `
+.data
+table:
+10 20 30
+.text
+SETI 1
+// there is no plain load instruction, so index the table with I
+LDAI table
+HALT
+`
+	want := []gmachine.Word{
+		gmachine.Word(gmachine.OpSETI), 1,
+		gmachine.Word(gmachine.OpLDAI), 5,
+		gmachine.Word(gmachine.OpHALT),
+		10, 20, 30,
+	}
+	got, err := gmachine.Assemble(strings.NewReader(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+	g := AssembleAndRunFromString(t, program)
+	var wantA gmachine.Word = 20
+	if wantA != g.A {
+		t.Error(cmp.Diff(wantA, g.A))
+	}
+}
+
+func TestTargetBeyondMemorySizeError(t *testing.T) {
+	t.Parallel()
+	a := gmachine.Assembler{MemSize: 64}
+	_, err := a.Assemble(strings.NewReader("NOOP\nJUMP 100000"))
+	if err == nil {
+		t.Fatal("want error for jump beyond memory, got nil")
+	}
+	wantPrefix := "2:6:"
+	if !strings.HasPrefix(err.Error(), wantPrefix) {
+		t.Errorf("want prefix %q, got %q", wantPrefix, err.Error())
+	}
+}
+
+func TestTargetWithinMemorySize(t *testing.T) {
+	t.Parallel()
+	a := gmachine.Assembler{MemSize: 64}
+	_, err := a.Assemble(strings.NewReader("JUMP end; LDAI 63; end: HALT"))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAssembleEmptyProgram(t *testing.T) {
+	t.Parallel()
+	for _, program := range []string{"", ";; ; \n", " \t\r\n"} {
+		got, err := gmachine.Assemble(strings.NewReader(program))
+		if err != nil {
+			t.Errorf("%q: want no error, got %v", program, err)
+		}
+		want := []gmachine.Word{}
+		if !cmp.Equal(want, got) {
+			t.Errorf("%q: %s", program, cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestUnreferencedLabelWarning(t *testing.T) {
+	t.Parallel()
+	program := "JUMP used\nunused:\nINCA\nused:\nHALT"
+	p, err := gmachine.AssembleProgram(strings.NewReader(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`2:1: label "unused" is never referenced`}
+	if !cmp.Equal(want, p.Warnings) {
+		t.Error(cmp.Diff(want, p.Warnings))
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	t.Parallel()
+	a := gmachine.Assembler{Origin: 100}
+	p, err := a.Assemble(strings.NewReader("start: JUMP start; JUMP $"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpJUMP), 100, gmachine.Word(gmachine.OpJUMP), 102}
+	if !cmp.Equal(want, p.Words) {
+		t.Error(cmp.Diff(want, p.Words))
+	}
+}
+
+func TestJMPRToLabelIsRelative(t *testing.T) {
+	t.Parallel()
+	for _, origin := range []gmachine.Word{0, 100} {
+		a := gmachine.Assembler{Origin: origin}
+		p, err := a.Assemble(strings.NewReader("loop: INCA; JMPR loop; JMPR end; end: HALT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []gmachine.Word{
+			gmachine.Word(gmachine.OpINCA),
+			gmachine.Word(gmachine.OpJMPR), negative(1),
+			gmachine.Word(gmachine.OpJMPR), 2,
+			gmachine.Word(gmachine.OpHALT),
+		}
+		if !cmp.Equal(want, p.Words) {
+			t.Errorf("origin %d: %s", origin, cmp.Diff(want, p.Words))
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	t.Parallel()
+	a := gmachine.Assembler{Align: 4}
+	p, err := a.Assemble(strings.NewReader("SETI 2; loop: DECI; JINZ loop; HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noop := gmachine.Word(gmachine.OpNOOP)
+	want := []gmachine.Word{
+		gmachine.Word(gmachine.OpSETI), 2, noop, noop,
+		gmachine.Word(gmachine.OpDECI), noop, noop, noop,
+		gmachine.Word(gmachine.OpJINZ), 4, noop, noop,
+		gmachine.Word(gmachine.OpHALT),
+	}
+	if !cmp.Equal(want, p.Words) {
+		t.Error(cmp.Diff(want, p.Words))
+	}
+	g := gmachine.New()
+	err = g.LoadProgram(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantI gmachine.Word = 0
+	if wantI != g.I {
+		t.Errorf("want loop to count I down to %d, got %d", wantI, g.I)
+	}
+}
+
+func TestDuplicateLabelError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("start:\nNOOP\nstart:\nHALT"))
+	if err == nil {
+		t.Fatal("want error for duplicate label, got nil")
+	}
+	want := `3:1: label "start" already defined at 1:1`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestInclude(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/include/main.g")
+	want := "Hi"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestCircularIncludeError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.AssembleFromFile("testdata/include/cycle_a.g")
+	if err == nil {
+		t.Fatal("want error for circular include, got nil")
+	}
+	want := "circular include: testdata/include/cycle_a.g -> testdata/include/cycle_b.g -> testdata/include/cycle_a.g"
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestIncludeWithoutQuotedNameError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("NOOP\n  #include lib.g\nHALT"))
+	if err == nil {
+		t.Fatal("want error for unquoted include, got nil")
+	}
+	want := "2:3: #include needs a quoted file name"
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestAssembleFromGzippedFile(t *testing.T) {
+	t.Parallel()
+	source, err := os.ReadFile("testdata/hello_world.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "hello_world.g.gz")
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write(source)
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filename, buf.Bytes(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := AssembleAndRunFromFile(t, "testdata/hello_world.g")
+	got := AssembleAndRunFromFile(t, filename)
+	wantOut := want.Out.(*bytes.Buffer).String()
+	gotOut := got.Out.(*bytes.Buffer).String()
+	if wantOut != gotOut {
+		t.Error(cmp.Diff(wantOut, gotOut))
+	}
+	if !cmp.Equal(want.Memory, got.Memory) {
+		t.Error("want same memory as the uncompressed program")
+	}
+}
+
+func TestAssembleFiles(t *testing.T) {
+	t.Parallel()
+	want, err := gmachine.AssembleFromFile("testdata/hello_world_with_labels.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := gmachine.Assembler{}.AssembleFiles("testdata/halting_program.g", "testdata/hello_world_with_labels.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Words) != len(want)+2 {
+		t.Fatalf("want %d words, got %d", len(want)+2, len(p.Words))
+	}
+	if p.Labels["main"] != 15 {
+		t.Errorf("want label main at 15, got %d", p.Labels["main"])
+	}
+}
+
+func TestMissingSecondArgumentError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("STIMM 100\nHALT"))
+	if err == nil {
+		t.Fatal("want error for missing second argument, got nil")
+	}
+	want := `2:1: unexpected instruction "HALT"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestMissingSecondArgumentAtEndError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("NOOP\nSTIMM 5"))
+	if err == nil {
+		t.Fatal("want error for missing second argument, got nil")
+	}
+	want := `2:1: missing argument to "STIMM"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestMissingArgumentError(t *testing.T) {
+	t.Parallel()
+	for _, op := range []string{"JINZ", "LDAI", "CMPI"} {
+		_, err := gmachine.Assemble(strings.NewReader(op + "\nHALT"))
+		if err == nil {
+			t.Errorf("%s: want error for missing argument, got nil", op)
+			continue
+		}
+		want := `2:1: unexpected instruction "HALT"`
+		if want != err.Error() {
+			t.Errorf("%s: want %q, got %q", op, want, err.Error())
+		}
+	}
+	for src, want := range map[string]string{
+		"NOOP\nLDAI":       `2:1: missing argument to "LDAI"`,
+		"JUMP\nloop: HALT": `2:1: unexpected label definition "loop:"`,
+	} {
+		_, err := gmachine.Assemble(strings.NewReader(src))
+		if err == nil {
+			t.Errorf("%q: want error for missing argument, got nil", src)
+			continue
+		}
+		if want != err.Error() {
+			t.Errorf("%q: want %q, got %q", src, want, err.Error())
+		}
+	}
+}
+
 func TestAssembleFromFile(t *testing.T) {
 	t.Parallel()
 	want := []gmachine.Word{
@@ -69,6 +510,18 @@ func TestSyntaxErrorOnLine(t *testing.T) {
 	}
 }
 
+func TestSyntaxErrorColumn(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.AssembleFromFile("testdata/syntax_error_column.g")
+	if err == nil {
+		t.Fatal("want syntax error, got nil")
+	}
+	want := `testdata/syntax_error_column.g:2:10: syntax error: invalid hexadecimal literal "0xG"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
 func TestAssemblyError(t *testing.T) {
 	t.Parallel()
 	_, err := gmachine.AssembleFromFile("testdata/assembly_error.g")
@@ -77,6 +530,152 @@ func TestAssemblyError(t *testing.T) {
 	}
 }
 
+func TestUnknownDirectiveError(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Assemble(strings.NewReader("NOOP\n.cosnt WIDTH 80\nHALT"))
+	if err == nil {
+		t.Fatal("want error for unknown directive, got nil")
+	}
+	want := `2:1: syntax error: unknown directive ".cosnt"`
+	got := err.Error()
+	if want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestConst(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader(".const WIDTH 80\nSETA WIDTH\n.CONST CH 'x'\nSETI CH\nHALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{
+		gmachine.Word(gmachine.OpSETA), 80,
+		gmachine.Word(gmachine.OpSETI), 'x',
+		gmachine.Word(gmachine.OpHALT),
+	}
+	if !cmp.Equal(want, words) {
+		t.Error(cmp.Diff(want, words))
+	}
+}
+
+func TestConstWithoutDot(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader("CONST WIDTH 80\nSETA WIDTH\nHALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpSETA), 80, gmachine.Word(gmachine.OpHALT)}
+	if !cmp.Equal(want, words) {
+		t.Error(cmp.Diff(want, words))
+	}
+}
+
+func TestConstIsNotAReservedLabel(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader("JUMP const; const: HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpJUMP), 2, gmachine.Word(gmachine.OpHALT)}
+	if !cmp.Equal(want, words) {
+		t.Error(cmp.Diff(want, words))
+	}
+}
+
+func TestConstErrors(t *testing.T) {
+	t.Parallel()
+	for src, want := range map[string]string{
+		".const WIDTH 80\n.const WIDTH 40": `2:8: constant "WIDTH" already defined at 1:1`,
+		"WIDTH:\n.const WIDTH 40\nHALT":    `2:8: constant "WIDTH" already defined as a label at 1:1`,
+		"SETA WIDTH\nHALT":                 `1:6: undefined label "WIDTH"`,
+		".const 80 WIDTH":                  `1:8: .const needs a name, got "80"`,
+		".const WIDTH HALT":                `1:14: .const WIDTH needs a number value, got "HALT"`,
+		"HALT\n.const WIDTH":               `2:1: incomplete .const definition`,
+	} {
+		_, err := gmachine.Assemble(strings.NewReader(src))
+		if err == nil {
+			t.Errorf("%q: want error, got nil", src)
+			continue
+		}
+		if want != err.Error() {
+			t.Errorf("%q: want %q, got %q", src, want, err.Error())
+		}
+	}
+}
+
+func TestWord(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader(`
+SETI 0
+LDAI greeting
+HALT
+greeting: .word 72 101 108 108 111 // Hello
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{
+		gmachine.Word(gmachine.OpSETI), 0,
+		gmachine.Word(gmachine.OpLDAI), 5,
+		gmachine.Word(gmachine.OpHALT),
+		72, 101, 108, 108, 111,
+	}
+	if !cmp.Equal(want, p.Words) {
+		t.Error(cmp.Diff(want, p.Words))
+	}
+	var wantLabel gmachine.Word = 5
+	if wantLabel != p.Labels["greeting"] {
+		t.Errorf("want greeting at %d, got %d", wantLabel, p.Labels["greeting"])
+	}
+}
+
+func TestDATA(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader("LDAI greeting; HALT; greeting: DATA 72 101 108 108 111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{
+		gmachine.Word(gmachine.OpLDAI), 3,
+		gmachine.Word(gmachine.OpHALT),
+		72, 101, 108, 108, 111,
+	}
+	if !cmp.Equal(want, p.Words) {
+		t.Error(cmp.Diff(want, p.Words))
+	}
+}
+
+func TestWordIsNotAReservedLabel(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader("JUMP data; data: HALT; .word data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpJUMP), 2, gmachine.Word(gmachine.OpHALT), 2}
+	if !cmp.Equal(want, words) {
+		t.Error(cmp.Diff(want, words))
+	}
+}
+
+func TestWordErrors(t *testing.T) {
+	t.Parallel()
+	for src, want := range map[string]string{
+		".word\n1":       `1:1: .word needs at least one value`,
+		"HALT; .word":    `1:7: .word needs at least one value`,
+		".word 1 2 HALT": `1:11: unexpected "HALT" in .word`,
+	} {
+		_, err := gmachine.Assemble(strings.NewReader(src))
+		if err == nil {
+			t.Errorf("%q: want error, got nil", src)
+			continue
+		}
+		if want != err.Error() {
+			t.Errorf("%q: want %q, got %q", src, want, err.Error())
+		}
+	}
+}
+
 func TestAssembleErrorReaderReturnsError(t *testing.T) {
 	t.Parallel()
 	reader := iotest.ErrReader(fmt.Errorf("some error"))
@@ -106,12 +705,14 @@ func TestTokenize(t *testing.T) {
 			Value:    5,
 			RawToken: "5",
 			Line:     2,
+			Col:      5,
 		},
 		{
 			Kind:     gmachine.TokenInstruction,
 			Value:    gmachine.Word(gmachine.OpHALT),
 			RawToken: "HALT",
 			Line:     3,
+			Col:      1,
 		},
 	}
 	got, err := gmachine.Tokenize("NOOP\nSETA 5 \n HALT\n")
@@ -132,6 +733,47 @@ func TestTokenizeError(t *testing.T) {
 	}
 }
 
+func TestTokenizeTokenTooLong(t *testing.T) {
+	t.Parallel()
+	tokenizer := gmachine.NewTokenizer()
+	tokenizer.MaxTokenLen = 10
+	_, err := tokenizer.Run("SETA 5\nSETA 12345678901")
+	if err == nil {
+		t.Fatal("want error for over-long token, got nil")
+	}
+	want := "2:6: syntax error: token too long"
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestTokenizeDefaultMaxTokenLen(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Tokenize(strings.Repeat("a", gmachine.DefaultMaxTokenLen))
+	if err != nil {
+		t.Errorf("want no error at the limit, got %v", err)
+	}
+	_, err = gmachine.Tokenize(strings.Repeat("a", gmachine.DefaultMaxTokenLen+1))
+	if err == nil || !strings.Contains(err.Error(), "token too long") {
+		t.Errorf("want token too long error beyond the limit, got %v", err)
+	}
+}
+
+func TestTokenizeMaxTokenLenIgnoresCommentsAndStrings(t *testing.T) {
+	t.Parallel()
+	long := strings.Repeat("x", gmachine.DefaultMaxTokenLen+1)
+	for _, program := range []string{
+		"// " + long + "\nHALT",
+		"/* " + long + " */ HALT",
+		`"` + long + `"`,
+	} {
+		_, err := gmachine.Tokenize(program)
+		if err != nil {
+			t.Errorf("want no error for long comment or string, got %v", err)
+		}
+	}
+}
+
 func TestTokenizeComment(t *testing.T) {
 	t.Parallel()
 	program := "//Hello"
@@ -141,6 +783,64 @@ func TestTokenizeComment(t *testing.T) {
 	}
 }
 
+func TestTokenizeBlockComment(t *testing.T) {
+	t.Parallel()
+	want := []gmachine.Token{
+		{
+			Kind:     gmachine.TokenInstruction,
+			Value:    gmachine.Word(gmachine.OpINCA),
+			RawToken: "INCA",
+			Line:     1,
+			Col:      0,
+		},
+		{
+			Kind:     gmachine.TokenInstruction,
+			Value:    gmachine.Word(gmachine.OpHALT),
+			RawToken: "HALT",
+			Line:     1,
+			Col:      16,
+		},
+	}
+	got, err := gmachine.Tokenize("INCA /* DECA */ HALT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTokenizeMultiLineBlockComment(t *testing.T) {
+	t.Parallel()
+	got, err := gmachine.Tokenize("INCA\n/* DECA\nDECA\n*/ HALT\nNOOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, token := range got {
+		lines = append(lines, token.Line)
+	}
+	want := []int{1, 4, 5}
+	if !cmp.Equal(want, lines) {
+		t.Error(cmp.Diff(want, lines))
+	}
+	if got[1].RawToken != "HALT" || got[1].Col != 3 {
+		t.Errorf("want HALT at column 3 after the comment, got %v at column %d", got[1], got[1].Col)
+	}
+}
+
+func TestTokenizeUnterminatedBlockComment(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Tokenize("INCA\n/* DECA\nHALT")
+	if err == nil {
+		t.Fatal("want error for unterminated block comment, got nil")
+	}
+	want := "unexpected EOF in block comment"
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
 func TestTokenizeLog(t *testing.T) {
 	t.Parallel()
 
@@ -176,6 +876,152 @@ func TestTokenize_RecognizeNumberLiterals(t *testing.T) {
 	}
 }
 
+func TestTokenize_RecognizeHexLiterals(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		program string
+		want    gmachine.Word
+	}
+	for _, c := range []testCase{
+		{program: "0xFF", want: 255},
+		{program: "0x0", want: 0},
+		{program: "0X1f", want: 31},
+		{program: "0xFFFFFFFFFFFFFFFF", want: math.MaxUint64},
+	} {
+		want := []gmachine.Token{
+			{
+				Kind:     gmachine.TokenNumberLiteral,
+				Value:    c.want,
+				RawToken: c.program,
+				Line:     1,
+			},
+		}
+		got, err := gmachine.Tokenize(c.program)
+		if err != nil {
+			t.Errorf("%s: want no error: got %v", c.program, err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestTokenize_RecognizeBinaryLiterals(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		program string
+		want    gmachine.Word
+	}
+	for _, c := range []testCase{
+		{program: "0b1010", want: 10},
+		{program: "0b0", want: 0},
+		{program: "0B11111111", want: 255},
+		{program: "0b" + strings.Repeat("1", 64), want: math.MaxUint64},
+	} {
+		want := []gmachine.Token{
+			{
+				Kind:     gmachine.TokenNumberLiteral,
+				Value:    c.want,
+				RawToken: c.program,
+				Line:     1,
+			},
+		}
+		got, err := gmachine.Tokenize(c.program)
+		if err != nil {
+			t.Errorf("%s: want no error: got %v", c.program, err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestTokenizeInvalidBinaryLiteral(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Tokenize("NOOP\nSETA 0b102")
+	if err == nil {
+		t.Fatal("want error for invalid binary literal, got nil")
+	}
+	want := `2:6: syntax error: invalid binary literal "0b102"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestTokenizeInvalidHexLiteral(t *testing.T) {
+	t.Parallel()
+	_, err := gmachine.Tokenize("NOOP\nSETA 0xZZ")
+	if err == nil {
+		t.Fatal("want error for invalid hex literal, got nil")
+	}
+	want := `2:6: syntax error: invalid hexadecimal literal "0xZZ"`
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestTokenizeStringLiteral(t *testing.T) {
+	t.Parallel()
+	want := []gmachine.Token{
+		{
+			Kind:     gmachine.TokenNumberLiteral,
+			Value:    65,
+			RawToken: "A",
+			Line:     1,
+			Col:      1,
+		},
+		{
+			Kind:     gmachine.TokenNumberLiteral,
+			Value:    66,
+			RawToken: "B",
+			Line:     1,
+			Col:      2,
+		},
+	}
+	got, err := gmachine.Tokenize(`"AB"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTokenizeStringLiteralEscapes(t *testing.T) {
+	t.Parallel()
+	tokens, err := gmachine.Tokenize(`"say \"hi\"\n\\"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []rune
+	for _, token := range tokens {
+		got = append(got, rune(token.Value))
+	}
+	want := []rune("say \"hi\"\n\\")
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(string(want), string(got)))
+	}
+}
+
+func TestTokenizeStringLiteralErrors(t *testing.T) {
+	t.Parallel()
+	for src, want := range map[string]string{
+		`"AB`:      "unexpected EOF in string literal",
+		`"AB\`:     "unexpected EOF in string literal",
+		"\"A\nB\"": "1:1: syntax error: newline in string literal",
+		`"\t"`:     `1:1: syntax error: unknown escape sequence "\\t" in string literal`,
+	} {
+		_, err := gmachine.Tokenize(src)
+		if err == nil {
+			t.Errorf("%q: want error, got nil", src)
+			continue
+		}
+		if want != err.Error() {
+			t.Errorf("%q: want %q, got %q", src, want, err.Error())
+		}
+	}
+}
+
 func TestTokenize_RecognizeRuneLiterals(t *testing.T) {
 	t.Parallel()
 	type testCase struct {
@@ -227,9 +1073,14 @@ func TestTokenize_RecognizeRuneLiterals(t *testing.T) {
 
 func FuzzTokenize(f *testing.F) {
 	f.Add("NOOP HALT SETA 5")
+	f.Add(strings.Repeat("9", gmachine.DefaultMaxTokenLen+1))
+	f.Add("/**/")
+	// Block comments are not emitted as tokens, so input which is only
+	// block comments and separators gives none.
+	blockComment := regexp.MustCompile(`(?s)/\*.*?\*/`)
 	f.Fuzz(func(t *testing.T, data string) {
 		got, err := gmachine.Tokenize(data)
-		if len(got) == 0 && err == nil && data != " " && data != "" {
+		if len(got) == 0 && err == nil && strings.Trim(blockComment.ReplaceAllString(data, ""), " \t\r\n;") != "" {
 			t.Error("expected at least one token if no error is produced")
 		}
 	})
@@ -0,0 +1,77 @@
+package gmachine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// binaryMagic identifies the output of AssembleToBinary.
+const binaryMagic = "GMCH"
+
+// binaryVersion is the version of the format written by AssembleToBinary.
+const binaryVersion byte = 1
+
+// AssembleToBinary assembles the source read from input and writes the
+// program to w in a compact binary format which LoadBinary can read without
+// assembling it again. The format is the magic "GMCH", a version byte and
+// the number of words as a uint64, followed by the words themselves, all in
+// little-endian byte order.
+func AssembleToBinary(input io.Reader, w io.Writer) error {
+	words, err := Assemble(input)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(binaryMagic)
+	bw.WriteByte(binaryVersion)
+	binary.Write(bw, binary.LittleEndian, uint64(len(words)))
+	binary.Write(bw, binary.LittleEndian, words)
+	return bw.Flush()
+}
+
+// LoadBinary reads a program written by AssembleToBinary and returns its
+// words, ready to be passed to Load.
+func LoadBinary(r io.Reader) ([]Word, error) {
+	header := make([]byte, len(binaryMagic)+1)
+	_, err := io.ReadFull(r, header)
+	if err != nil || string(header[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("not an assembled G-machine program")
+	}
+	if version := header[len(binaryMagic)]; version != binaryVersion {
+		return nil, fmt.Errorf("unsupported assembled program version %d", version)
+	}
+	var count uint64
+	err = binary.Read(r, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, errors.New("assembled program is truncated")
+	}
+	// The count is checked against the data actually present, rather than
+	// trusted, so a corrupt header cannot cause a huge allocation.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data))%8 != 0 || uint64(len(data))/8 != count {
+		return nil, fmt.Errorf("assembled program should have %d words, but has %d bytes of data", count, len(data))
+	}
+	words := make([]Word, count)
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, words)
+	return words, nil
+}
+
+// LoadFromBytes loads a program given as raw words, each encoded as 8 bytes in
+// little-endian order, like Load.
+func (g *Machine) LoadFromBytes(b []byte) error {
+	if len(b)%8 != 0 {
+		return fmt.Errorf("program length %d bytes is not a whole number of words", len(b))
+	}
+	words := make([]Word, len(b)/8)
+	for i := range words {
+		words[i] = Word(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return g.Load(words)
+}
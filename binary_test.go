@@ -0,0 +1,82 @@
+package gmachine_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAssembleToBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+	want, err := gmachine.Assemble(strings.NewReader("NOOP halt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = gmachine.AssembleToBinary(strings.NewReader("NOOP halt"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gmachine.LoadBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLoadBinaryRejectsInvalidData(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	err := gmachine.AssembleToBinary(strings.NewReader("NOOP halt"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for name, input := range map[string][]byte{
+		"empty":       nil,
+		"bad magic":   append([]byte("XXXX"), data[4:]...),
+		"bad version": append(append([]byte("GMCH"), 99), data[5:]...),
+		"truncated":   data[:len(data)-3],
+		"extra words": append(append([]byte{}, data...), make([]byte, 8)...),
+	} {
+		_, err := gmachine.LoadBinary(bytes.NewReader(input))
+		if err == nil {
+			t.Errorf("%s: want error, got nil", name)
+		}
+	}
+}
+
+func TestLoadFromBytes(t *testing.T) {
+	t.Parallel()
+	b := binary.LittleEndian.AppendUint64(nil, uint64(gmachine.OpINCA))
+	b = binary.LittleEndian.AppendUint64(b, uint64(gmachine.OpHALT))
+	g := gmachine.New()
+	err := g.LoadFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpINCA), gmachine.Word(gmachine.OpHALT)}
+	if !cmp.Equal(want, g.Memory[:2]) {
+		t.Error(cmp.Diff(want, g.Memory[:2]))
+	}
+}
+
+func TestLoadFromBytesRejectsInvalidLength(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	for name, b := range map[string][]byte{
+		"partial word":   make([]byte, 12),
+		"too many words": make([]byte, 8*(gmachine.DefaultMemSize+1)),
+	} {
+		err := g.LoadFromBytes(b)
+		if err == nil {
+			t.Errorf("%s: want error, got nil", name)
+		}
+	}
+}
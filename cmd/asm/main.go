@@ -0,0 +1,10 @@
+package main
+
+import (
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"os"
+)
+
+func main() {
+	os.Exit(gmachine.MainAsm())
+}
@@ -1,38 +1,16 @@
 package main
 
 import (
-	_ "embed"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
-)
-
-const mainData = `package main
-
-import (
-	_ "embed"
-	"fmt"
-	"os"
 
 	gmachine "github.com/bit-gophers/merit-gmachine"
 )
 
-//go:embed target.g
-var mainData string
-
-func main() {
-	g := gmachine.New()
-	err := g.AssembleAndRunFromString(mainData)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-}`
-
 func main() {
 	var fn string
 	if len(os.Args) < 2 {
@@ -50,26 +28,14 @@ func makeCompiler(fn string) error {
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpDir)
-
-	mainFile := tmpDir + "/main.go"
-	file, err := os.Open(fn)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	defer os.RemoveAll(tmpDir)
 
-	runFile := tmpDir + "/target.g"
-	openedFile, err := os.OpenFile(runFile, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer openedFile.Close()
-
-	_, err = io.Copy(openedFile, file)
+	src, err := os.ReadFile(fn)
 	if err != nil {
 		return err
 	}
+	mainFile := tmpDir + "/main.go"
+	mainData := gmachine.CompileToGo(path.Base(fn), string(src))
 	if err := os.WriteFile(mainFile, []byte(mainData), 0644); err != nil {
 		return err
 	}
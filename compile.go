@@ -0,0 +1,66 @@
+package gmachine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const compileHeader = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+)
+
+func main() {
+	g := gmachine.New()
+	words, err := gmachine.Assemble(strings.NewReader(program))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:%v\n", filename, err)
+		os.Exit(1)
+	}
+	err = g.Load(words)
+	if err == nil {
+		err = g.Run()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// filename is the name of the G-machine source file, used to prefix
+// assembly errors.
+const filename = `
+
+// compileProgram declares the program's source, whose lines follow it.
+const compileProgram = `
+
+// program is the G-machine source, with line directives pointing each of
+// its lines back at the original file.
+var program = ""`
+
+// CompileToGo returns the source of a Go main package which assembles and
+// runs the G-machine program src. The program text is emitted one source
+// line at a time, each preceded by a //line directive referring to the
+// corresponding line of filename, and assembly errors are reported with
+// filename as a prefix.
+func CompileToGo(filename, src string) string {
+	b := new(strings.Builder)
+	b.WriteString(compileHeader)
+	b.WriteString(strconv.Quote(filename))
+	b.WriteString(compileProgram)
+	lines := strings.SplitAfter(src, "\n")
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		fmt.Fprintf(b, " +\n//line %s:%d\n\t%s", filename, i+1, strconv.Quote(line))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
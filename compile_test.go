@@ -0,0 +1,68 @@
+package gmachine_test
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+)
+
+func TestCompileToGo(t *testing.T) {
+	t.Parallel()
+	src, err := os.ReadFile("testdata/fib.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := gmachine.CompileToGo("fib.g", string(src))
+	_, err = parser.ParseFile(token.NewFileSet(), "main.go", got, 0)
+	if err != nil {
+		t.Fatalf("generated code does not parse: %v\n%s", err, got)
+	}
+	lines := strings.Count(string(src), "\n") + 1
+	for line := 1; line <= lines; line++ {
+		directive := fmt.Sprintf("\n//line fib.g:%d\n", line)
+		if !strings.Contains(got, directive) {
+			t.Errorf("want directive %q in:\n%s", directive, got)
+		}
+	}
+}
+
+func TestCompileToGoReportsAssemblyErrorsWithFilename(t *testing.T) {
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("skipping go run in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	// The generated program imports this module, so it must be built
+	// from inside it.
+	dir, err := os.MkdirTemp(".", "compile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	mainFile := filepath.Join(dir, "main.go")
+	err = os.WriteFile(mainFile, []byte(gmachine.CompileToGo("bad.g", "NOOP\nFOO\n")), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(goTool, "run", mainFile)
+	stderr := new(strings.Builder)
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("want compiled program to fail on an assembly error, got nil")
+	}
+	wantPrefix := "bad.g:2:1:"
+	if !strings.HasPrefix(stderr.String(), wantPrefix) {
+		t.Errorf("want stderr to start with %q, got %q", wantPrefix, stderr.String())
+	}
+}
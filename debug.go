@@ -0,0 +1,129 @@
+package gmachine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// debugPrompt reads debugger commands from r until one of them resumes
+// execution. It reports whether the machine should continue running without
+// pausing again, which is requested with "c". The command "set" changes a
+// register or memory word:
+//
+//	set A 10
+//	set mem 20 99
+//
+// Any other input, including an empty line, steps a single instruction.
+func (g *Machine) debugPrompt(r *bufio.Reader) (continuing bool) {
+	for {
+		line, _, err := r.ReadLine()
+		if err != nil {
+			return false
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			return false
+		}
+		switch fields[0] {
+		case "c":
+			return true
+		case "set":
+			err := g.debugSet(fields[1:])
+			if err != nil {
+				fmt.Fprintln(g.Out, err)
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func (g *Machine) debugSet(args []string) error {
+	switch {
+	case len(args) == 3 && strings.EqualFold(args[0], "mem"):
+		addr, err := strconv.ParseUint(args[1], 0, 64)
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseUint(args[2], 0, 64)
+		if err != nil {
+			return err
+		}
+		if addr >= uint64(len(g.Memory)) {
+			return fmt.Errorf("address %d out of range", addr)
+		}
+		g.Memory[addr] = Word(value)
+	case len(args) == 2:
+		value, err := strconv.ParseUint(args[1], 0, 64)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(args[0], "Z") {
+			g.Z = value != 0
+			return nil
+		}
+		if strings.EqualFold(args[0], "N") {
+			g.N = value != 0
+			return nil
+		}
+		reg := g.register(args[0])
+		if reg == nil {
+			return fmt.Errorf("unknown register %q", args[0])
+		}
+		*reg = Word(value)
+	default:
+		return errors.New("usage: set REGISTER VALUE or set mem ADDRESS VALUE")
+	}
+	return nil
+}
+
+// register returns a pointer to the register with the given name, or nil if
+// there is no such register.
+func (g *Machine) register(name string) *Word {
+	switch strings.ToUpper(name) {
+	case "A":
+		return &g.A
+	case "I":
+		return &g.I
+	case "P":
+		return &g.P
+	case "X":
+		return &g.X
+	case "Y":
+		return &g.Y
+	case "SP":
+		return &g.SP
+	}
+	return nil
+}
+
+// DumpMemory returns the words of memory from start up to, but not
+// including, end, eight to a line, with each line preceded by the address of
+// its first word:
+//
+//	000016: 000001 000002 000003 000004 000005 000006 000007 000008
+//
+// The range is clamped to the machine's memory, so an end beyond it dumps to
+// the last word and a start after end gives an empty dump.
+func (g *Machine) DumpMemory(start, end Word) string {
+	if end > Word(len(g.Memory)) {
+		end = Word(len(g.Memory))
+	}
+	b := new(strings.Builder)
+	for addr := start; addr < end; addr++ {
+		if (addr-start)%8 == 0 {
+			if addr != start {
+				b.WriteByte('\n')
+			}
+			fmt.Fprintf(b, "%06v:", addr)
+		}
+		fmt.Fprintf(b, " %06v", g.Memory[addr])
+	}
+	if start < end {
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package gmachine
+
+// TableDecoder is a Decoder which dispatches instructions through a table of
+// functions indexed by opcode, rather than the switch in DefaultDecoder. It
+// exists to compare the cost of the two strategies, and behaves identically
+// to DefaultDecoder: only the register and jump instructions which dominate
+// hot loops are in the table, and any other opcode is passed on to
+// DefaultDecoder.
+type TableDecoder struct{}
+
+func (TableDecoder) Execute(g *Machine, op OpCode) (halted bool, err error) {
+	if int(op) < len(opTable) && opTable[op] != nil {
+		opTable[op](g)
+		return false, nil
+	}
+	return DefaultDecoder{}.Execute(g, op)
+}
+
+// opTable holds the instructions executed by TableDecoder itself. None of
+// them can halt the machine or fail.
+var opTable = [...]func(g *Machine){
+	OpNOOP: func(g *Machine) {},
+	OpINCA: func(g *Machine) { g.A++ },
+	OpDECA: func(g *Machine) { g.A-- },
+	OpSETA: func(g *Machine) { g.A = g.Fetch() },
+	OpSETI: func(g *Machine) { g.I = g.Fetch() },
+	OpDECI: func(g *Machine) { g.I-- },
+	OpJINZ: func(g *Machine) {
+		if g.I != 0 {
+			g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	},
+	OpMVAY: func(g *Machine) { g.Y = g.A },
+	OpADXY: func(g *Machine) { g.Y += g.X },
+	OpMVAX: func(g *Machine) { g.X = g.A },
+	OpMVYA: func(g *Machine) { g.A = g.Y },
+	OpJUMP: func(g *Machine) { g.P = g.Fetch() },
+	OpINCI: func(g *Machine) { g.I++ },
+	OpSUBA: func(g *Machine) {
+		g.A -= g.X
+		g.N = int64(g.A) < 0
+	},
+}
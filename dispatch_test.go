@@ -0,0 +1,73 @@
+package gmachine_test
+
+import (
+	"strings"
+	"testing"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"github.com/google/go-cmp/cmp"
+)
+
+// loopProgram spends nearly all its time in a tight loop of register
+// instructions, like fib.g but for longer.
+const loopProgram = `
+SETI 1000
+loop:
+INCA
+MVAX
+ADXY
+MVYA
+SUBA
+DECI
+JINZ loop
+HALT
+`
+
+func TestTableDecoderMatchesDefaultDecoder(t *testing.T) {
+	t.Parallel()
+	for _, program := range []string{loopProgram, countingProgram, "SETA 5; PUSHA; SETA 9; MVAX; POPA; DIVAX; HALT", "SETA 2; MVAX; SETA 1; SUBA; HALT"} {
+		want := newGMachineFromProgram(t, program)
+		err := want.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := newGMachineFromProgram(t, program)
+		got.Decoder = gmachine.TableDecoder{}
+		err = got.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(want.SaveState(), got.SaveState()) {
+			t.Errorf("want same final state from both decoders for %q:\nswitch: %v\ntable:  %v", program, want, got)
+		}
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	words, err := gmachine.Assemble(strings.NewReader(loopProgram))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bc := range []struct {
+		name    string
+		decoder gmachine.Decoder
+	}{
+		{"switch", nil},
+		{"table", gmachine.TableDecoder{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			g := gmachine.New()
+			g.Decoder = bc.decoder
+			for i := 0; i < b.N; i++ {
+				err := g.Load(words)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = g.Run()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -3,17 +3,38 @@ package gmachine
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
+	"math/rand"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"unicode"
 	"unicode/utf8"
 )
 
+// ErrAssertionFailed is returned by Run when an ASSERTZ instruction finds
+// that A is not zero.
+var ErrAssertionFailed = errors.New("assertion failed")
+
+// ErrMaxCycles is returned by Run when the machine executes MaxCycles
+// instructions without halting.
+var ErrMaxCycles = errors.New("exceeded max cycles")
+
+// ErrMaxWrites is returned by Run when an instruction would store to memory
+// after MaxWrites stores have already been made.
+var ErrMaxWrites = errors.New("write limit exceeded")
+
 // DefaultMemSize is the number of 64-bit words of memory which will be
 // allocated to a new G-machine by default.
 const DefaultMemSize = 1024
@@ -39,6 +60,55 @@ const (
 	OpLDAI
 	OpCMPI
 	OpJNEQ
+	OpABSA
+	OpMIN
+	OpMAX
+	OpBIT
+	OpSETBIT
+	OpCLRBIT
+	OpDBG
+	OpINCSAT
+	OpDECSAT
+	OpROL
+	OpROR
+	OpASSERTZ
+	OpSWAPW
+	OpSTIMM
+	OpSUBA
+	OpLDAA
+	OpPUSHA
+	OpPOPA
+	OpSTAX
+	OpCALL
+	OpRET
+	OpINA
+	OpCMOVZ
+	OpMULAX
+	OpDIVAX
+	OpOUTH
+	OpJMPZ
+	OpANDAX
+	OpORAX
+	OpXORAX
+	OpSHLA
+	OpSHRA
+	OpJMPR
+	OpSTAI
+	OpOUTNUM
+	OpJN
+	OpMVXA
+	OpMVXY
+	OpMVYX
+	OpMVAI
+	OpMVIA
+	OpMVIX
+	OpMVXI
+	OpMVIY
+	OpMVYI
+	OpSETX
+	OpSETY
+	OpDJNZ
+	OpRAND
 )
 
 const (
@@ -48,13 +118,21 @@ const (
 	TokenRuneLiteral
 	TokenLabelDefinition
 	TokenLabelReference
+	TokenCurrentAddress
+	TokenDirective
 
 	eof rune = 0
 )
 
 var kind = map[int]string{
-	TokenInstruction:   "instruction",
-	TokenNumberLiteral: "number literal",
+	TokenInstruction:     "instruction",
+	TokenComment:         "comment",
+	TokenNumberLiteral:   "number literal",
+	TokenRuneLiteral:     "rune literal",
+	TokenLabelDefinition: "label definition",
+	TokenLabelReference:  "label reference",
+	TokenCurrentAddress:  "current address",
+	TokenDirective:       "directive",
 }
 
 type Word uint64
@@ -63,78 +141,600 @@ type Machine struct {
 	Memory        []Word
 	A, I, P, X, Y Word
 	Z             bool
-	Out           io.Writer
-	In            io.Reader
-	Debug         bool
+
+	// N is the negative flag, set by SUBA when its result is negative
+	// as a two's complement value.
+	N bool
+
+	// SP is the stack pointer, the address at which PUSHA will store the
+	// next value. The stack starts at the top of memory and grows down
+	// towards the program.
+	SP Word
+
+	Out   io.Writer
+	In    io.Reader
+	Debug bool
+
+	// OnOutput, if set, is called with each rune written by OUTA instead
+	// of writing it to Out.
+	OnOutput func(r rune)
+
+	// OnInput, if set, is called by INA for the next rune of input instead
+	// of reading In. It returns false at the end of the input.
+	OnInput func() (rune, bool)
+
+	// Decoder, if set, executes each instruction in place of
+	// DefaultDecoder.
+	Decoder Decoder
+
+	// MemTrace, if set, receives a line for every memory access made by
+	// an instruction, giving its address and value. Fetching
+	// instructions and their arguments is not traced.
+	MemTrace io.Writer
+
+	// Trace, if set, makes Run write a line to Out for every instruction
+	// it executes, giving its address, the instruction and the value of A
+	// afterwards. Unlike Debug, it never waits for input.
+	Trace bool
+
+	// Labels maps addresses to the names of labels defined there. It is
+	// set by LoadProgram, and used to show jump targets by name.
+	Labels map[Word]string
+
+	// MaxCycles, if nonzero, is the number of instructions Run executes
+	// before giving up with ErrMaxCycles.
+	MaxCycles uint64
+
+	// MaxWrites, if nonzero, is the number of memory stores, including
+	// pushes onto the stack, which Run allows before failing with
+	// ErrMaxWrites.
+	MaxWrites uint64
+
+	// Profiling, if set, makes the machine count how many times it
+	// executes each opcode, in Profile.
+	Profiling bool
+	Profile   map[OpCode]uint64
+
+	// Watches holds memory addresses which Run watches. When an
+	// instruction changes the word at one of them, Run prints its old and
+	// new values and pauses as it does at a breakpoint.
+	Watches []Word
+
+	// Breakpoints holds the addresses at which Run pauses for debugger
+	// commands, as it does before every instruction in Debug mode.
+	Breakpoints map[Word]bool
+
+	// Rand is the source of the values RAND loads into A. New seeds it
+	// with a fixed value, so that runs are reproducible unless it is
+	// replaced.
+	Rand *rand.Rand
+
+	// CheckStackBalance, if set, makes each RET check that SP is where
+	// the matching CALL left it, failing with "stack imbalance in
+	// subroutine" if the subroutine pushed more than it popped or the
+	// other way round.
+	CheckStackBalance bool
+
+	firmwareSize int
+	programSize  int
+	watchHits    []string
+	writes       uint64
+	recorder     io.Writer
+	replay       io.Reader
+	// callSP holds the value of SP after each CALL which has not yet
+	// returned, when CheckStackBalance is set.
+	callSP []Word
 }
 
 func New() *Machine {
+	return NewWithMemory(DefaultMemSize)
+}
+
+// NewWithMemory is like New, but gives the machine size words of memory
+// rather than DefaultMemSize. It panics if size is not positive.
+func NewWithMemory(size int) *Machine {
+	if size <= 0 {
+		panic(fmt.Sprintf("gmachine: memory size %d is not positive", size))
+	}
 	return &Machine{
-		Memory: make([]Word, DefaultMemSize),
+		Memory: make([]Word, size),
+		SP:     Word(size - 1),
 		In:     os.Stdin,
 		Out:    os.Stdout,
+		Rand:   newRand(),
 	}
 }
 
+// Limits set by SafeMode, unless smaller ones are already set.
+const (
+	safeMaxCycles = 100_000_000
+	safeMaxWrites = 10_000_000
+)
+
+// SafeMode turns on the runtime checks meant for running untrusted
+// programs: MaxCycles and MaxWrites are given generous limits if they are
+// not already set, and CheckStackBalance is set. Memory accesses, jumps and
+// the stack are always checked, so a program which goes out of bounds fails
+// with an error in any mode.
+func (g *Machine) SafeMode() {
+	if g.MaxCycles == 0 || g.MaxCycles > safeMaxCycles {
+		g.MaxCycles = safeMaxCycles
+	}
+	if g.MaxWrites == 0 || g.MaxWrites > safeMaxWrites {
+		g.MaxWrites = safeMaxWrites
+	}
+	g.CheckStackBalance = true
+}
+
+// Reset returns the machine to the state New leaves it in, reusing its
+// memory: the registers, flags and memory are zeroed, SP points to the top
+// of memory again, Rand is reseeded, and any loaded program, firmware,
+// labels and profile are forgotten. Settings such as In, Out, Debug and
+// Breakpoints are kept.
+func (g *Machine) Reset() {
+	clear(g.Memory)
+	g.A, g.I, g.P, g.X, g.Y = 0, 0, 0, 0, 0
+	g.Z, g.N = false, false
+	g.SP = Word(len(g.Memory) - 1)
+	g.firmwareSize = 0
+	g.programSize = 0
+	g.Labels = nil
+	g.Profile = nil
+	g.watchHits = nil
+	g.callSP = nil
+	g.Rand = newRand()
+}
+
+// newRand returns the source of random values a new machine starts with.
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(1))
+}
+
 func (g *Machine) Run() error {
+	_, err := g.RunN()
+	return err
+}
+
+// RunN is like Run, but also returns the number of instructions executed,
+// including the HALT.
+func (g *Machine) RunN() (steps uint64, err error) {
+	return g.run(context.Background(), nil)
+}
+
+// RunContext is like Run, but stops with the context's error if ctx is
+// done before the machine halts.
+func (g *Machine) RunContext(ctx context.Context) error {
+	_, err := g.run(ctx, nil)
+	return err
+}
+
+// run runs the machine until it halts, fails or ctx is done, returning the
+// number of instructions executed successfully. If stop is not nil, run also
+// returns once stop reports true after an instruction.
+func (g *Machine) run(ctx context.Context, stop func() bool) (steps uint64, err error) {
 	var inReader *bufio.Reader
-	if g.Debug {
+	if g.Debug || len(g.Breakpoints) > 0 || len(g.Watches) > 0 {
 		inReader = bufio.NewReader(g.In)
 	}
 
-	for {
-		if g.Debug {
+	// In Debug mode the machine pauses before every instruction until
+	// told to continue. Otherwise it pauses only at breakpoints.
+	continuing := !g.Debug
+	g.writes = 0
+	for ; ; steps++ {
+		if g.MaxCycles > 0 && steps >= g.MaxCycles {
+			return steps, fmt.Errorf("%w (%d) at P=%d", ErrMaxCycles, g.MaxCycles, g.P)
+		}
+		if !continuing || g.Breakpoints[g.P] {
 			fmt.Fprint(g.Out, g.String())
-			inReader.ReadLine()
+			continuing = g.debugPrompt(inReader)
 		}
 
-		op := g.Fetch()
-		switch OpCode(op) {
-		case OpHALT:
-			return nil
-		case OpNOOP:
-		case OpINCA:
-			g.A++
-		case OpDECA:
-			g.A--
-		case OpSETA:
-			g.A = g.Fetch()
-		case OpSETI:
-			g.I = g.Fetch()
-		case OpDECI:
-			g.I--
-		case OpJINZ:
-			if g.I != 0 {
-				g.P = g.Fetch()
-			} else {
-				g.P++
+		select {
+		case <-ctx.Done():
+			return steps, ctx.Err()
+		default:
+		}
+		var p Word
+		var instruction string
+		if g.Trace {
+			p, instruction = g.P, g.DecodeNextInstruction()
+		}
+		halted, err := g.step()
+		if g.Trace && err == nil {
+			fmt.Fprintf(g.Out, "%06v: %s A: %06v\n", p, instruction, g.A)
+		}
+		if len(g.watchHits) > 0 {
+			for _, hit := range g.watchHits {
+				fmt.Fprint(g.Out, hit)
+			}
+			g.watchHits = g.watchHits[:0]
+			if err == nil && !halted {
+				fmt.Fprint(g.Out, g.String())
+				continuing = g.debugPrompt(inReader)
 			}
-		case OpMVAY:
-			g.Y = g.A
-		case OpADXY:
-			g.Y += g.X
-		case OpMVAX:
-			g.X = g.A
-		case OpMVYA:
-			g.A = g.Y
-		case OpOUTA:
+		}
+		if err != nil {
+			return steps, err
+		}
+		if halted || (stop != nil && stop()) {
+			return steps + 1, nil
+		}
+	}
+}
+
+// ProfileReport returns a table of the opcodes counted in Profile, most
+// frequently executed first.
+func (g *Machine) ProfileReport() string {
+	ops := make([]OpCode, 0, len(g.Profile))
+	for op := range g.Profile {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if g.Profile[ops[i]] != g.Profile[ops[j]] {
+			return g.Profile[ops[i]] > g.Profile[ops[j]]
+		}
+		return ops[i] < ops[j]
+	})
+	b := new(strings.Builder)
+	tw := tabwriter.NewWriter(b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPCODE\tCOUNT")
+	for _, op := range ops {
+		name := op.String()
+		if name == "" {
+			name = strconv.Itoa(int(op))
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", name, g.Profile[op])
+	}
+	tw.Flush()
+	return b.String()
+}
+
+// Watch makes Run pause whenever an instruction changes the word at addr.
+func (g *Machine) Watch(addr Word) {
+	g.Watches = append(g.Watches, addr)
+}
+
+// AddBreakpoint makes Run pause before executing the instruction at addr.
+func (g *Machine) AddBreakpoint(addr Word) {
+	if g.Breakpoints == nil {
+		g.Breakpoints = map[Word]bool{}
+	}
+	g.Breakpoints[addr] = true
+}
+
+// RunUntilOutput is like Run, but also stops once the output written since
+// the call contains pattern. The output includes runes passed to OnOutput,
+// and anything written to Out, such as Trace lines.
+func (g *Machine) RunUntilOutput(pattern string) error {
+	w := &watchWriter{w: g.Out, pattern: []byte(pattern)}
+	out, onOutput := g.Out, g.OnOutput
+	g.Out = w
+	if onOutput != nil {
+		g.OnOutput = func(r rune) {
+			onOutput(r)
+			w.note([]byte(string(r)))
+		}
+	}
+	defer func() { g.Out, g.OnOutput = out, onOutput }()
+	_, err := g.run(context.Background(), func() bool { return w.matched })
+	return err
+}
+
+// watchWriter passes writes through to w, noting when the output written so
+// far contains pattern.
+type watchWriter struct {
+	w       io.Writer
+	pattern []byte
+	tail    []byte
+	matched bool
+}
+
+func (w *watchWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.note(p[:n])
+	return n, err
+}
+
+// note records p as written, without passing it on.
+func (w *watchWriter) note(p []byte) {
+	w.tail = append(w.tail, p...)
+	if bytes.Contains(w.tail, w.pattern) {
+		w.matched = true
+	}
+	if keep := len(w.pattern) - 1; len(w.tail) > keep && keep >= 0 {
+		w.tail = w.tail[len(w.tail)-keep:]
+	}
+}
+
+// step executes the instruction at P, reporting whether it halted the
+// machine. It returns an error if P, or any of the instruction's arguments,
+// is outside memory, as happens after a jump to a bad address.
+func (g *Machine) step() (halted bool, err error) {
+	if g.P >= Word(len(g.Memory)) {
+		return false, fmt.Errorf("P %d out of range", g.P)
+	}
+	op := OpCode(g.Fetch())
+	if g.P+Word(op.ArgCount()) > Word(len(g.Memory)) {
+		return false, fmt.Errorf("arguments of %s at %d out of range", op, g.P-1)
+	}
+	if g.Profiling {
+		if g.Profile == nil {
+			g.Profile = map[OpCode]uint64{}
+		}
+		g.Profile[op]++
+	}
+	if g.Decoder != nil {
+		return g.Decoder.Execute(g, op)
+	}
+	return DefaultDecoder{}.Execute(g, op)
+}
+
+// Decoder executes instructions on behalf of a Machine. Setting the
+// machine's Decoder changes what each opcode does, or adds new ones, without
+// changing the machine itself.
+type Decoder interface {
+	// Execute executes the instruction op on g, reporting whether it
+	// halted the machine. P has already been advanced past op, so any
+	// argument is read with g.Fetch.
+	Execute(g *Machine, op OpCode) (halted bool, err error)
+}
+
+// DefaultDecoder is the Decoder which implements the standard G-machine
+// instruction set. It is used when a Machine has no Decoder set.
+type DefaultDecoder struct{}
+
+func (DefaultDecoder) Execute(g *Machine, op OpCode) (halted bool, err error) {
+	switch op {
+	case OpHALT:
+		return true, nil
+	case OpNOOP:
+	case OpINCA:
+		g.A++
+	case OpDECA:
+		g.A--
+	case OpSETA:
+		g.A = g.Fetch()
+	case OpSETI:
+		g.I = g.Fetch()
+	case OpSETX:
+		g.X = g.Fetch()
+	case OpSETY:
+		g.Y = g.Fetch()
+	case OpDECI:
+		g.I--
+	case OpJINZ:
+		if g.I != 0 {
+			g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	case OpDJNZ:
+		g.I--
+		if g.I != 0 {
+			g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	case OpRAND:
+		value, err := g.random()
+		if err != nil {
+			return false, err
+		}
+		g.A = value
+	case OpMVAY:
+		g.Y = g.A
+	case OpADXY:
+		g.Y += g.X
+	case OpMVAX:
+		g.X = g.A
+	case OpMVYA:
+		g.A = g.Y
+	case OpOUTA:
+		if g.OnOutput != nil {
+			g.OnOutput(rune(g.A))
+		} else {
 			fmt.Fprintf(g.Out, "%c", g.A)
-		case OpJUMP:
+		}
+	case OpJUMP:
+		g.P = g.Fetch()
+	case OpINCI:
+		g.I++
+	case OpLDAI:
+		value, err := g.load(g.I + g.Fetch())
+		if err != nil {
+			return false, err
+		}
+		g.A = value
+	case OpCMPI:
+		g.Z = g.I == g.Fetch()
+	case OpJNEQ:
+		if !g.Z {
 			g.P = g.Fetch()
-		case OpINCI:
-			g.I++
-		case OpLDAI:
-			g.A = g.Memory[g.I+g.Fetch()]
-		case OpCMPI:
-			g.Z = g.I == g.Fetch()
-		case OpJNEQ:
-			if !g.Z {
-				g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	case OpABSA:
+		// A is treated as a signed two's complement value. The most
+		// negative value has no positive counterpart, so it is left as is.
+		if int64(g.A) < 0 {
+			g.A = -g.A
+		}
+	case OpMIN:
+		// MIN and MAX compare A and X as unsigned values, so a negative
+		// two's complement value (see ABSA) counts as larger than any
+		// positive one.
+		g.A = min(g.A, g.X)
+	case OpMAX:
+		g.A = max(g.A, g.X)
+	case OpBIT:
+		n, err := g.fetchBit()
+		if err != nil {
+			return false, err
+		}
+		g.Z = (g.A>>n)&1 == 1
+	case OpSETBIT:
+		n, err := g.fetchBit()
+		if err != nil {
+			return false, err
+		}
+		g.A |= 1 << n
+	case OpCLRBIT:
+		n, err := g.fetchBit()
+		if err != nil {
+			return false, err
+		}
+		g.A &^= 1 << n
+	case OpDBG:
+		fmt.Fprintln(g.Out, g.String())
+	case OpINCSAT:
+		if g.A != math.MaxUint64 {
+			g.A++
+		}
+	case OpDECSAT:
+		if g.A != 0 {
+			g.A--
+		}
+	case OpROL:
+		g.A = Word(bits.RotateLeft64(uint64(g.A), int(g.X%64)))
+	case OpROR:
+		g.A = Word(bits.RotateLeft64(uint64(g.A), -int(g.X%64)))
+	case OpASSERTZ:
+		if g.A != 0 {
+			return false, fmt.Errorf("%w at %d: A is %d", ErrAssertionFailed, g.P-1, g.A)
+		}
+	case OpSWAPW:
+		g.A = Word(bits.RotateLeft64(uint64(g.A), 32))
+	case OpSTIMM:
+		addr := g.Fetch()
+		value := g.Fetch()
+		err := g.store(addr, value)
+		if err != nil {
+			return false, err
+		}
+	case OpSUBA:
+		// Word is unsigned, so if X is greater than A the result wraps
+		// around: 2 - 3 gives the largest Word value. Read as two's
+		// complement that is -1, so N is set from the sign bit.
+		g.A -= g.X
+		g.N = int64(g.A) < 0
+	case OpLDAA:
+		value, err := g.load(g.A)
+		if err != nil {
+			return false, err
+		}
+		g.A = value
+	case OpPUSHA:
+		err := g.push(g.A)
+		if err != nil {
+			return false, err
+		}
+	case OpPOPA:
+		value, err := g.pop()
+		if err != nil {
+			return false, err
+		}
+		g.A = value
+	case OpSTAX:
+		err := g.store(g.X, g.A)
+		if err != nil {
+			return false, err
+		}
+	case OpCALL:
+		target := g.Fetch()
+		err := g.push(g.P)
+		if err != nil {
+			return false, err
+		}
+		g.P = target
+		if g.CheckStackBalance {
+			g.callSP = append(g.callSP, g.SP)
+		}
+	case OpRET:
+		if g.CheckStackBalance && len(g.callSP) > 0 {
+			want := g.callSP[len(g.callSP)-1]
+			g.callSP = g.callSP[:len(g.callSP)-1]
+			if g.SP != want {
+				return false, fmt.Errorf("stack imbalance in subroutine: SP is %d at RET, want %d", g.SP, want)
 			}
-		default:
-			return fmt.Errorf("unknown opcode %d", op)
 		}
+		addr, err := g.pop()
+		if err != nil {
+			return false, err
+		}
+		g.P = addr
+	case OpINA:
+		// Z is set at the end of the input, and cleared otherwise, so a
+		// program can read until EOF with JNEQ.
+		r, ok, err := g.input()
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			g.Z = true
+			break
+		}
+		g.A = Word(r)
+		g.Z = false
+	case OpCMOVZ:
+		if g.Z {
+			g.A = g.X
+		}
+	case OpMULAX:
+		// Like other arithmetic, products too large for a Word wrap
+		// around, keeping only the low 64 bits.
+		g.A *= g.X
+	case OpDIVAX:
+		if g.X == 0 {
+			return false, fmt.Errorf("division by zero at P=%d", g.P-1)
+		}
+		g.A, g.Y = g.A/g.X, g.A%g.X
+	case OpOUTH:
+		fmt.Fprintf(g.Out, "%#x", g.A)
+	case OpJMPZ:
+		if g.Z {
+			g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	case OpANDAX:
+		g.A &= g.X
+	case OpORAX:
+		g.A |= g.X
+	case OpXORAX:
+		g.A ^= g.X
+	case OpSHLA:
+		// Go defines shifting an unsigned value by its width or more as
+		// giving zero, so shifts by 64 or more clear A.
+		g.A <<= g.X
+	case OpSHRA:
+		g.A >>= g.X
+	case OpJMPR:
+		// The offset is a two's complement value relative to the address
+		// of the JMPR itself, so adding it wraps around for negative
+		// offsets.
+		offset := g.Fetch()
+		g.P = g.P - 2 + offset
+	case OpSTAI:
+		err := g.store(g.I+g.Fetch(), g.A)
+		if err != nil {
+			return false, err
+		}
+	case OpOUTNUM:
+		fmt.Fprintf(g.Out, "%d", g.A)
+	case OpJN:
+		if g.N {
+			g.P = g.Fetch()
+		} else {
+			g.P++
+		}
+	case OpMVXA, OpMVXY, OpMVYX, OpMVAI, OpMVIA, OpMVIX, OpMVXI, OpMVIY, OpMVYI:
+		dst, src := g.moveRegisters(op)
+		*dst = *src
+	default:
+		return false, fmt.Errorf("unknown opcode %d", op)
 	}
+	return false, nil
 }
 
 func (g *Machine) Fetch() Word {
@@ -143,79 +743,437 @@ func (g *Machine) Fetch() Word {
 	return op
 }
 
+// load returns the word at addr on behalf of an instruction, or an error if
+// addr is outside memory.
+func (g *Machine) load(addr Word) (Word, error) {
+	if addr >= Word(len(g.Memory)) {
+		return 0, fmt.Errorf("address %d out of range", addr)
+	}
+	value := g.Memory[addr]
+	if g.MemTrace != nil {
+		fmt.Fprintf(g.MemTrace, "read %d %d\n", addr, value)
+	}
+	return value, nil
+}
+
+// store writes value to the word at addr on behalf of an instruction,
+// returning an error if addr is outside memory.
+func (g *Machine) store(addr, value Word) error {
+	if addr >= Word(len(g.Memory)) {
+		return fmt.Errorf("address %d out of range", addr)
+	}
+	if g.MaxWrites > 0 && g.writes >= g.MaxWrites {
+		return fmt.Errorf("%w (%d) at address %d", ErrMaxWrites, g.MaxWrites, addr)
+	}
+	g.writes++
+	old := g.Memory[addr]
+	g.Memory[addr] = value
+	if g.MemTrace != nil {
+		fmt.Fprintf(g.MemTrace, "write %d %d\n", addr, value)
+	}
+	if old != value && slices.Contains(g.Watches, addr) {
+		g.watchHits = append(g.watchHits, fmt.Sprintf("watch %d: %d -> %d\n", addr, old, value))
+	}
+	return nil
+}
+
+// moveRegisters returns the destination and source registers of a move
+// instruction. A move named MVsd copies register s to register d.
+func (g *Machine) moveRegisters(op OpCode) (dst, src *Word) {
+	switch op {
+	case OpMVXA:
+		return &g.A, &g.X
+	case OpMVXY:
+		return &g.Y, &g.X
+	case OpMVYX:
+		return &g.X, &g.Y
+	case OpMVAI:
+		return &g.I, &g.A
+	case OpMVIA:
+		return &g.A, &g.I
+	case OpMVIX:
+		return &g.X, &g.I
+	case OpMVXI:
+		return &g.I, &g.X
+	case OpMVIY:
+		return &g.Y, &g.I
+	case OpMVYI:
+		return &g.I, &g.Y
+	}
+	panic(fmt.Sprintf("%s is not a move instruction", op))
+}
+
+// push stores value at SP and moves SP down, returning an error if the
+// stack would run into the program.
+func (g *Machine) push(value Word) error {
+	if g.SP < Word(g.programSize) || g.SP >= Word(len(g.Memory)-g.firmwareSize) {
+		return fmt.Errorf("stack overflow at %d", g.SP)
+	}
+	err := g.store(g.SP, value)
+	if err != nil {
+		return err
+	}
+	g.SP--
+	return nil
+}
+
+// pop moves SP up and returns the value stored there, returning an error if
+// the stack is empty.
+func (g *Machine) pop() (Word, error) {
+	if g.SP+1 >= Word(len(g.Memory)-g.firmwareSize) {
+		return 0, errors.New("stack underflow")
+	}
+	g.SP++
+	return g.load(g.SP)
+}
+
+// fetchBit fetches the argument of a bit instruction, checking that it is a
+// valid bit index for a Word.
+func (g *Machine) fetchBit() (Word, error) {
+	n := g.Fetch()
+	if n >= 64 {
+		return 0, fmt.Errorf("bit %d out of range", n)
+	}
+	return n, nil
+}
+
 func (g *Machine) Peek() Word {
 	op := g.Memory[g.P+1]
 	return op
 }
 
 func (g *Machine) DecodeNextInstruction() string {
+	if g.P >= Word(len(g.Memory)) {
+		return ""
+	}
 	opCode := OpCode(g.Memory[g.P])
 
 	result := opCode.String()
 
-	if opCode.RequiresArgument() {
-		result += fmt.Sprintf(" %v", g.Peek())
+	for i := 1; i <= opCode.ArgCount() && g.P+Word(i) < Word(len(g.Memory)); i++ {
+		arg := g.Memory[g.P+Word(i)]
+		if label, ok := g.Labels[arg]; ok && opCode.isJump() {
+			result += " " + label
+			continue
+		}
+		result += fmt.Sprintf(" %v", arg)
 	}
 
 	return result
 }
 
 func (g *Machine) Load(data []Word) error {
-	if len(data) > len(g.Memory) {
+	err := g.LoadWarm(data)
+	if err != nil {
+		return err
+	}
+	g.P = g.entry()
+	return nil
+}
+
+// LoadProgram loads the words of p like Load, and sets Labels from the labels
+// it defines.
+func (g *Machine) LoadProgram(p Program) error {
+	err := g.Load(p.Words)
+	if err != nil {
+		return err
+	}
+	g.Labels = invertOrdered(p.Labels)
+	return nil
+}
+
+// LoadWarm loads data at address 0 like Load, but leaves P and the other
+// registers as they are, so that a running program can pick up the new code
+// from where it left off.
+func (g *Machine) LoadWarm(data []Word) error {
+	if len(data) > len(g.Memory)-g.firmwareSize {
 		return errors.New("program size exceeds memory size")
 	}
 
 	copy(g.Memory, data)
-	g.P = 0
+	g.programSize = len(data)
 	return nil
 }
 
+// AssembleAndRunFromReader assembles the program read from r, loads it and
+// runs it. Assembly errors are prefixed with name, if it is not empty, which
+// identifies the source in the same way as a filename does for
+// AssembleFromFile.
+func (g *Machine) AssembleAndRunFromReader(name string, r io.Reader) error {
+	program, err := AssembleProgram(r)
+	if err != nil {
+		if name == "" {
+			return err
+		}
+		return fmt.Errorf("%s:%w", name, err)
+	}
+	err = g.LoadProgram(program)
+	if err != nil {
+		return err
+	}
+	return g.Run()
+}
+
+// AssembleAndRunFromString assembles src, loads it and runs it.
+func (g *Machine) AssembleAndRunFromString(src string) error {
+	return g.AssembleAndRunFromReader("", strings.NewReader(src))
+}
+
+// AssembleAndRunFromFile assembles the named file, loads it and runs it. If
+// debug is true, the machine pauses before each instruction as though Debug
+// were set; otherwise Debug is cleared.
+func (g *Machine) AssembleAndRunFromFile(filename string, debug bool) error {
+	program, err := AssembleProgramFromFile(filename)
+	if err != nil {
+		return err
+	}
+	err = g.LoadProgram(program)
+	if err != nil {
+		return err
+	}
+	g.Debug = debug
+	return g.Run()
+}
+
+// Eval assembles src and runs it against the current state of the machine,
+// leaving the results in its registers. The snippet is placed in a scratch
+// area directly after the loaded program, so the program itself is left
+// intact, and an error is returned if it would reach the stack. P is
+// restored once the snippet halts.
+func (g *Machine) Eval(src string) error {
+	origin := g.programSize
+	p, err := Assembler{Origin: Word(origin)}.Assemble(strings.NewReader(src))
+	if err != nil {
+		return err
+	}
+	if origin+len(p.Words)+1 > len(g.Memory)-g.firmwareSize {
+		return errors.New("snippet size exceeds memory size")
+	}
+	if Word(origin+len(p.Words)) >= g.SP {
+		return errors.New("snippet would overwrite the stack")
+	}
+	copy(g.Memory[origin:], p.Words)
+	g.Memory[origin+len(p.Words)] = Word(OpHALT)
+	resume := g.P
+	g.P = Word(origin)
+	err = g.Run()
+	g.P = resume
+	return err
+}
+
+// LoadFirmware places bootstrap code at the top of memory and sets P to its
+// first word, so that it runs before the program loaded at address 0. The
+// stack is moved to start below the firmware. The firmware hands over
+// control by ending with JUMP 0. As it is not loaded at address 0, any
+// addresses the firmware refers to must be absolute.
+func (g *Machine) LoadFirmware(words []Word) error {
+	if len(words) > len(g.Memory) {
+		return errors.New("firmware size exceeds memory size")
+	}
+	if len(words) > len(g.Memory)-g.programSize {
+		return errors.New("firmware would overwrite the loaded program")
+	}
+
+	start := len(g.Memory) - len(words)
+	copy(g.Memory[start:], words)
+	g.firmwareSize = len(words)
+	g.P = Word(start)
+	g.SP = Word(start - 1)
+	return nil
+}
+
+// entry returns the address at which execution starts: the firmware if
+// there is any, or else the program at address 0.
+func (g *Machine) entry() Word {
+	if g.firmwareSize == 0 {
+		return 0
+	}
+	return Word(len(g.Memory) - g.firmwareSize)
+}
+
 func MainRun() int {
 	debug := flag.Bool("debug", false, "If true print debug output")
+	tokens := flag.Bool("tokens", false, "If true print the program's tokens instead of running it")
+	stats := flag.Bool("stats", false, "If true print assembly statistics instead of running the program")
+	buffer := flag.Bool("buffer", false, "If true buffer the program's output, writing it when the program stops")
+	timeout := flag.Duration("timeout", 0, "If nonzero stop the program with an error if it runs for longer than this")
+	disasm := flag.Bool("disasm", false, "If true print the disassembled program instead of running it")
+	safe := flag.Bool("safe", false, "If true turn on all runtime safety checks, for running untrusted programs")
 	flag.Parse()
+	if *stats {
+		p, err := AssembleProgramFromFile(flag.Arg(0))
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("tokens: %d\nwords: %d\ntime: %v\n", p.Stats.Tokens, p.Stats.Words, p.Stats.Duration)
+		return 0
+	}
+	if *tokens {
+		data, err := os.ReadFile(flag.Arg(0))
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			return 1
+		}
+		result, err := Tokenize(string(data))
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			return 1
+		}
+		PrintTokens(os.Stdout, result)
+		return 0
+	}
 	g := New()
 	g.Debug = *debug
-	program, err := AssembleFromFile(flag.Arg(0))
+	if *safe {
+		g.SafeMode()
+	}
+	if *buffer {
+		out := bufio.NewWriter(os.Stdout)
+		defer out.Flush()
+		g.Out = out
+	}
+	program, err := Assembler{}.AssembleFiles(flag.Args()...)
+	if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		return 1
+	}
+	for _, warning := range program.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	if *disasm {
+		listing, err := Disassemble(program.Words)
+		fmt.Print(listing)
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	err = g.LoadProgram(program)
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return 1
 	}
-	err = g.Load(program)
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err = g.RunContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "program timed out after %v", *timeout)
+		return 1
+	}
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return 1
 	}
-	err = g.Run()
+	return 0
+}
+
+// MainAsm assembles the files named on the command line as a single program
+// and prints its words in decimal, one per line, so that the output can be
+// compared against a golden file.
+func MainAsm() int {
+	flag.Parse()
+	program, err := Assembler{}.AssembleFiles(flag.Args()...)
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return 1
 	}
+	for _, warning := range program.Warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	for _, word := range program.Words {
+		fmt.Println(word)
+	}
 	return 0
 }
 
 // Map of assembly instructions to OP codes
 var instructions = map[string]OpCode{
-	"ADXY": OpADXY,
-	"DECA": OpDECA,
-	"DECI": OpDECI,
-	"HALT": OpHALT,
-	"INCA": OpINCA,
-	"JINZ": OpJINZ,
-	"MVAX": OpMVAX,
-	"MVAY": OpMVAY,
-	"MVYA": OpMVYA,
-	"NOOP": OpNOOP,
-	"OUTA": OpOUTA,
-	"SETA": OpSETA,
-	"SETI": OpSETI,
-	"JUMP": OpJUMP,
-	"INCI": OpINCI,
-	"LDAI": OpLDAI,
-	"CMPI": OpCMPI,
-	"JNEQ": OpJNEQ,
-}
-
-var opCodes = InvertMap(instructions)
+	"ADXY":    OpADXY,
+	"DECA":    OpDECA,
+	"DECI":    OpDECI,
+	"HALT":    OpHALT,
+	"INCA":    OpINCA,
+	"JINZ":    OpJINZ,
+	"MVAX":    OpMVAX,
+	"MVAY":    OpMVAY,
+	"MVYA":    OpMVYA,
+	"NOOP":    OpNOOP,
+	"OUTA":    OpOUTA,
+	"SETA":    OpSETA,
+	"SETI":    OpSETI,
+	"JUMP":    OpJUMP,
+	"INCI":    OpINCI,
+	"LDAI":    OpLDAI,
+	"CMPI":    OpCMPI,
+	"JNEQ":    OpJNEQ,
+	"ABSA":    OpABSA,
+	"MIN":     OpMIN,
+	"MAX":     OpMAX,
+	"BIT":     OpBIT,
+	"SETBIT":  OpSETBIT,
+	"CLRBIT":  OpCLRBIT,
+	"DBG":     OpDBG,
+	"INCSAT":  OpINCSAT,
+	"DECSAT":  OpDECSAT,
+	"ROL":     OpROL,
+	"ROR":     OpROR,
+	"ASSERTZ": OpASSERTZ,
+	"SWAPW":   OpSWAPW,
+	"STIMM":   OpSTIMM,
+	"SUBA":    OpSUBA,
+	"LDAA":    OpLDAA,
+	"PUSHA":   OpPUSHA,
+	"POPA":    OpPOPA,
+	"STAX":    OpSTAX,
+	"CALL":    OpCALL,
+	"RET":     OpRET,
+	"INA":     OpINA,
+	"CMOVZ":   OpCMOVZ,
+	"MULAX":   OpMULAX,
+	"DIVAX":   OpDIVAX,
+	"OUTH":    OpOUTH,
+	"JMPZ":    OpJMPZ,
+	"ANDAX":   OpANDAX,
+	"ORAX":    OpORAX,
+	"XORAX":   OpXORAX,
+	"SHLA":    OpSHLA,
+	"SHRA":    OpSHRA,
+	"JMPR":    OpJMPR,
+	"STAI":    OpSTAI,
+	"OUTNUM":  OpOUTNUM,
+	"JN":      OpJN,
+	"MVXA":    OpMVXA,
+	"MVXY":    OpMVXY,
+	"MVYX":    OpMVYX,
+	"MVAI":    OpMVAI,
+	"MVIA":    OpMVIA,
+	"MVIX":    OpMVIX,
+	"MVXI":    OpMVXI,
+	"MVIY":    OpMVIY,
+	"MVYI":    OpMVYI,
+	"SETX":    OpSETX,
+	"SETY":    OpSETY,
+	"DJNZ":    OpDJNZ,
+	"RAND":    OpRAND,
+}
+
+var opCodes = invertOrdered(instructions)
+
+// Set of assembler directives
+var directives = map[string]bool{
+	".const": true,
+	"const":  true,
+	".data":  true,
+	"data":   true,
+	".text":  true,
+	".word":  true,
+}
 
 type Instruction struct {
 	OpCode           Word
@@ -227,12 +1185,47 @@ type Token struct {
 	Value    Word
 	RawToken string
 	Line     int
-	Col      int
+
+	// Col is the zero-based column, in runes, at which the token starts.
+	// Error messages give columns counting from 1.
+	Col int
+
+	// File is the name of the file the token was read from, when the
+	// program is assembled from several files.
+	File string
 }
 
+// RequiresArgument reports whether the instruction is followed by at least one
+// argument word. This includes JINZ, LDAI and CMPI, so the assembler rejects
+// them without an argument rather than taking the next instruction as one.
 func (o OpCode) RequiresArgument() bool {
+	return o.ArgCount() > 0
+}
+
+// ArgCount returns the number of argument words which follow the
+// instruction.
+func (o OpCode) ArgCount() int {
 	switch o {
-	case OpSETA, OpSETI, OpJUMP, OpJNEQ:
+	case OpSETA, OpSETI, OpJINZ, OpJUMP, OpLDAI, OpCMPI, OpJNEQ, OpBIT, OpSETBIT, OpCLRBIT, OpCALL, OpJMPZ, OpJMPR, OpSTAI, OpJN, OpSETX, OpSETY, OpDJNZ:
+		return 1
+	case OpSTIMM:
+		return 2
+	}
+
+	return 0
+}
+
+// size returns the number of words occupied by the instruction, including
+// its arguments.
+func (o OpCode) size() int {
+	return 1 + o.ArgCount()
+}
+
+// isJump reports whether the instruction may transfer control to the
+// address given in its argument.
+func (o OpCode) isJump() bool {
+	switch o {
+	case OpJINZ, OpJUMP, OpJNEQ, OpCALL, OpJMPZ, OpJN, OpDJNZ:
 		return true
 	}
 
@@ -247,6 +1240,14 @@ func (t Token) String() string {
 	return fmt.Sprintf("%q (%d) %s", t.RawToken, t.Value, kind[t.Kind])
 }
 
+// where describes the position of the token for error messages.
+func (t Token) where() string {
+	if t.File == "" {
+		return fmt.Sprintf("%d:%d", t.Line, t.Col+1)
+	}
+	return fmt.Sprintf("%s:%d:%d", t.File, t.Line, t.Col+1)
+}
+
 func newToken(rawToken []rune) (Token, error) {
 	stringToken := string(rawToken)
 	if strings.HasPrefix(stringToken, "//") {
@@ -256,12 +1257,60 @@ func newToken(rawToken []rune) (Token, error) {
 		}, nil
 	}
 
+	if directives[strings.ToLower(stringToken)] {
+		return Token{
+			Kind:     TokenDirective,
+			RawToken: stringToken,
+		}, nil
+	}
+	if strings.HasPrefix(stringToken, ".") {
+		return Token{}, fmt.Errorf("unknown directive %q", stringToken)
+	}
+
+	if strings.HasPrefix(stringToken, "$") {
+		offset := 0
+		if rest := stringToken[1:]; rest != "" {
+			var err error
+			offset, err = strconv.Atoi(rest)
+			if err != nil || (rest[0] != '+' && rest[0] != '-') {
+				return Token{}, fmt.Errorf("invalid current address expression %q", stringToken)
+			}
+		}
+		return Token{
+			Kind:     TokenCurrentAddress,
+			Value:    Word(offset),
+			RawToken: stringToken,
+		}, nil
+	}
+
 	tokenKind := TokenInstruction
 	value, ok := instructions[strings.ToUpper(stringToken)]
 	if !ok {
 		if utf8.RuneCountInString(stringToken) == 3 && strings.HasPrefix(stringToken, "'") && strings.HasSuffix(stringToken, "'") {
 			tokenKind = TokenRuneLiteral
 			value = OpCode([]rune(stringToken)[1])
+		} else if strings.HasPrefix(stringToken, "0x") || strings.HasPrefix(stringToken, "0X") {
+			tokenKind = TokenNumberLiteral
+			converted, err := strconv.ParseUint(stringToken, 0, 64)
+			if err != nil {
+				return Token{}, fmt.Errorf("invalid hexadecimal literal %q", stringToken)
+			}
+			value = OpCode(converted)
+		} else if strings.HasPrefix(stringToken, "0b") || strings.HasPrefix(stringToken, "0B") {
+			tokenKind = TokenNumberLiteral
+			converted, err := strconv.ParseUint(stringToken, 0, 64)
+			if err != nil {
+				return Token{}, fmt.Errorf("invalid binary literal %q", stringToken)
+			}
+			value = OpCode(converted)
+		} else if len(rawToken) > 1 && (rawToken[0] == '+' || rawToken[0] == '-') && unicode.IsDigit(rawToken[1]) {
+			// Signed literals are stored in two's complement.
+			tokenKind = TokenNumberLiteral
+			converted, err := strconv.ParseInt(stringToken, 10, 64)
+			if err != nil {
+				return Token{}, fmt.Errorf("invalid signed literal %q", stringToken)
+			}
+			value = OpCode(converted)
 		} else if unicode.IsDigit(rawToken[0]) {
 			tokenKind = TokenNumberLiteral
 			converted, err := strconv.Atoi(stringToken)
@@ -283,9 +1332,11 @@ func newToken(rawToken []rune) (Token, error) {
 }
 
 func (g *Machine) String() string {
-	return fmt.Sprintf(`P: %06v A: %06v I: %06v X: %06v Y: %06v Z: %v NEXT: %v`, g.P, g.A, g.I, g.X, g.Y, g.Z, g.DecodeNextInstruction())
+	return fmt.Sprintf(`P: %06v A: %06v I: %06v X: %06v Y: %06v Z: %v N: %v NEXT: %v`, g.P, g.A, g.I, g.X, g.Y, g.Z, g.N, g.DecodeNextInstruction())
 }
 
+// InvertMap returns a map from the values of m to their keys. Where several
+// keys share a value, which of them is used is unspecified.
 func InvertMap[K, V comparable](m map[K]V) map[V]K {
 	result := map[V]K{}
 
@@ -295,3 +1346,19 @@ func InvertMap[K, V comparable](m map[K]V) map[V]K {
 
 	return result
 }
+
+// invertOrdered is like InvertMap, but where several keys share a value the
+// smallest of them is used, so that the result does not depend on the order
+// of iteration over m.
+func invertOrdered[K cmp.Ordered, V comparable](m map[K]V) map[V]K {
+	result := map[V]K{}
+
+	for k, v := range m {
+		if existing, ok := result[v]; ok && existing < k {
+			continue
+		}
+		result[v] = k
+	}
+
+	return result
+}
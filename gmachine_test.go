@@ -2,10 +2,16 @@ package gmachine_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	gmachine "github.com/bit-gophers/merit-gmachine"
 
@@ -77,83 +83,1572 @@ func TestDECA(t *testing.T) {
 	}
 }
 
-func TestSubtract2From3Gives1(t *testing.T) {
+func TestABSA(t *testing.T) {
 	t.Parallel()
-	g := AssembleAndRunFromFile(t, "testdata/subtract2from3.g")
+	type testCase struct {
+		name string
+		a    gmachine.Word
+		want gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "positive", a: 5, want: 5},
+		{name: "negative", a: negative(5), want: 5},
+		{name: "most negative", a: 1 << 63, want: 1 << 63},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			g := runWords(t, gmachine.Word(gmachine.OpSETA), c.a, gmachine.Word(gmachine.OpABSA), gmachine.Word(gmachine.OpHALT))
+			if c.want != g.A {
+				t.Error(cmp.Diff(c.want, g.A))
+			}
+		})
+	}
+}
+
+func TestMINAndMAX(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name    string
+		a, x    gmachine.Word
+		wantMin gmachine.Word
+		wantMax gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "A less than X", a: 3, x: 7, wantMin: 3, wantMax: 7},
+		{name: "A greater than X", a: 9, x: 2, wantMin: 2, wantMax: 9},
+		{name: "A equal to X", a: 4, x: 4, wantMin: 4, wantMax: 4},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			for op, want := range map[gmachine.OpCode]gmachine.Word{
+				gmachine.OpMIN: c.wantMin,
+				gmachine.OpMAX: c.wantMax,
+			} {
+				g := runWords(t,
+					gmachine.Word(gmachine.OpSETA), c.x,
+					gmachine.Word(gmachine.OpMVAX),
+					gmachine.Word(gmachine.OpSETA), c.a,
+					gmachine.Word(op),
+					gmachine.Word(gmachine.OpHALT),
+				)
+				if want != g.A {
+					t.Errorf("%s: %s", op, cmp.Diff(want, g.A))
+				}
+			}
+		})
+	}
+}
+
+func TestBIT(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; BIT 2; HALT")
+	if !g.Z {
+		t.Error("want Z set for set bit 2 of 5")
+	}
+	g = AssembleAndRunFromString(t, "SETA 5; BIT 1; HALT")
+	if g.Z {
+		t.Error("want Z clear for clear bit 1 of 5")
+	}
+}
+
+func TestBITOutOfRangeReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 5; BIT 64; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for bit 64, got nil")
+	}
+}
+
+func TestSETBITAndCLRBIT(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		program string
+		want    gmachine.Word
+	}
+	for _, c := range []testCase{
+		{program: "SETA 5; SETBIT 1; HALT", want: 7},
+		{program: "SETA 5; SETBIT 2; HALT", want: 5},
+		{program: "SETA 5; SETBIT 63; HALT", want: 1<<63 | 5},
+		{program: "SETA 5; CLRBIT 2; HALT", want: 1},
+		{program: "SETA 5; CLRBIT 1; HALT", want: 5},
+		{program: "SETA 5; CLRBIT 0; HALT", want: 4},
+	} {
+		g := AssembleAndRunFromString(t, c.program)
+		if c.want != g.A {
+			t.Errorf("%s: %s", c.program, cmp.Diff(c.want, g.A))
+		}
+	}
+}
+
+func TestSETBITAndCLRBITOutOfRangeReturnError(t *testing.T) {
+	t.Parallel()
+	for _, program := range []string{"SETBIT 64; HALT", "CLRBIT 100; HALT"} {
+		g := newGMachineFromProgram(t, program)
+		err := g.Run()
+		if err == nil {
+			t.Errorf("%s: want error, got nil", program)
+		}
+	}
+}
+
+func TestINCSATAndDECSAT(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name string
+		a    gmachine.Word
+		op   gmachine.OpCode
+		want gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "INCSAT", a: 5, op: gmachine.OpINCSAT, want: 6},
+		{name: "INCSAT at max", a: math.MaxUint64, op: gmachine.OpINCSAT, want: math.MaxUint64},
+		{name: "DECSAT", a: 5, op: gmachine.OpDECSAT, want: 4},
+		{name: "DECSAT at zero", a: 0, op: gmachine.OpDECSAT, want: 0},
+	} {
+		g := runWords(t, gmachine.Word(gmachine.OpSETA), c.a, gmachine.Word(c.op), gmachine.Word(gmachine.OpHALT))
+		if c.want != g.A {
+			t.Errorf("%s: %s", c.name, cmp.Diff(c.want, g.A))
+		}
+	}
+}
+
+func TestROLAndROR(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name string
+		op   gmachine.OpCode
+		a, x gmachine.Word
+		want gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "ROL", op: gmachine.OpROL, a: 0xF0, x: 4, want: 0xF00},
+		{name: "ROL wraps", op: gmachine.OpROL, a: 1<<63 | 1, x: 1, want: 3},
+		{name: "ROL by 64", op: gmachine.OpROL, a: 0xF0, x: 64, want: 0xF0},
+		{name: "ROL by 65", op: gmachine.OpROL, a: 0xF0, x: 65, want: 0x1E0},
+		{name: "ROR", op: gmachine.OpROR, a: 0xF0, x: 4, want: 0xF},
+		{name: "ROR wraps", op: gmachine.OpROR, a: 1<<63 | 1, x: 1, want: 1<<63 | 1<<62},
+		{name: "ROR by 64", op: gmachine.OpROR, a: 0xF0, x: 64, want: 0xF0},
+	} {
+		g := runWords(t,
+			gmachine.Word(gmachine.OpSETA), c.x,
+			gmachine.Word(gmachine.OpMVAX),
+			gmachine.Word(gmachine.OpSETA), c.a,
+			gmachine.Word(c.op),
+			gmachine.Word(gmachine.OpHALT),
+		)
+		if c.want != g.A {
+			t.Errorf("%s: want %#x, got %#x", c.name, c.want, g.A)
+		}
+	}
+}
+
+func TestBitwiseLogic(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name string
+		op   gmachine.OpCode
+		a, x gmachine.Word
+		want gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "ANDAX", op: gmachine.OpANDAX, a: 0b1100, x: 0b1010, want: 0b1000},
+		{name: "ANDAX masks", op: gmachine.OpANDAX, a: 0x1234, x: 0xFF, want: 0x34},
+		{name: "ORAX", op: gmachine.OpORAX, a: 0b1100, x: 0b1010, want: 0b1110},
+		{name: "XORAX", op: gmachine.OpXORAX, a: 0b1100, x: 0b1010, want: 0b0110},
+		{name: "XORAX with itself", op: gmachine.OpXORAX, a: 0xDEADBEEF, x: 0xDEADBEEF, want: 0},
+	} {
+		g := runWords(t,
+			gmachine.Word(gmachine.OpSETA), c.x,
+			gmachine.Word(gmachine.OpMVAX),
+			gmachine.Word(gmachine.OpSETA), c.a,
+			gmachine.Word(c.op),
+			gmachine.Word(gmachine.OpHALT),
+		)
+		if c.want != g.A {
+			t.Errorf("%s: want %#x, got %#x", c.name, c.want, g.A)
+		}
+	}
+}
+
+func TestSHLAAndSHRA(t *testing.T) {
+	t.Parallel()
+	type testCase struct {
+		name string
+		op   gmachine.OpCode
+		a, x gmachine.Word
+		want gmachine.Word
+	}
+	for _, c := range []testCase{
+		{name: "SHLA", op: gmachine.OpSHLA, a: 3, x: 4, want: 48},
+		{name: "SHLA drops high bits", op: gmachine.OpSHLA, a: 1<<63 | 1, x: 1, want: 2},
+		{name: "SHLA by 63", op: gmachine.OpSHLA, a: 1, x: 63, want: 1 << 63},
+		{name: "SHLA by 64", op: gmachine.OpSHLA, a: 1, x: 64, want: 0},
+		{name: "SHRA", op: gmachine.OpSHRA, a: 48, x: 4, want: 3},
+		{name: "SHRA is unsigned", op: gmachine.OpSHRA, a: 1 << 63, x: 63, want: 1},
+		{name: "SHRA by 64", op: gmachine.OpSHRA, a: 1 << 63, x: 64, want: 0},
+	} {
+		g := runWords(t,
+			gmachine.Word(gmachine.OpSETA), c.x,
+			gmachine.Word(gmachine.OpMVAX),
+			gmachine.Word(gmachine.OpSETA), c.a,
+			gmachine.Word(c.op),
+			gmachine.Word(gmachine.OpHALT),
+		)
+		if c.want != g.A {
+			t.Errorf("%s: want %#x, got %#x", c.name, c.want, g.A)
+		}
+	}
+}
+
+func TestMoveInstructions(t *testing.T) {
+	t.Parallel()
+	type registers struct {
+		A, X, Y, I gmachine.Word
+	}
+	start := registers{A: 1, X: 2, Y: 3, I: 4}
+	for op, want := range map[gmachine.OpCode]registers{
+		gmachine.OpMVAX: {A: 1, X: 1, Y: 3, I: 4},
+		gmachine.OpMVAY: {A: 1, X: 2, Y: 1, I: 4},
+		gmachine.OpMVAI: {A: 1, X: 2, Y: 3, I: 1},
+		gmachine.OpMVXA: {A: 2, X: 2, Y: 3, I: 4},
+		gmachine.OpMVXY: {A: 1, X: 2, Y: 2, I: 4},
+		gmachine.OpMVXI: {A: 1, X: 2, Y: 3, I: 2},
+		gmachine.OpMVYA: {A: 3, X: 2, Y: 3, I: 4},
+		gmachine.OpMVYX: {A: 1, X: 3, Y: 3, I: 4},
+		gmachine.OpMVYI: {A: 1, X: 2, Y: 3, I: 3},
+		gmachine.OpMVIA: {A: 4, X: 2, Y: 3, I: 4},
+		gmachine.OpMVIX: {A: 1, X: 4, Y: 3, I: 4},
+		gmachine.OpMVIY: {A: 1, X: 2, Y: 4, I: 4},
+	} {
+		g := runWords(t,
+			gmachine.Word(gmachine.OpSETA), start.X,
+			gmachine.Word(gmachine.OpMVAX),
+			gmachine.Word(gmachine.OpSETA), start.Y,
+			gmachine.Word(gmachine.OpMVAY),
+			gmachine.Word(gmachine.OpSETI), start.I,
+			gmachine.Word(gmachine.OpSETA), start.A,
+			gmachine.Word(op),
+			gmachine.Word(gmachine.OpHALT),
+		)
+		got := registers{A: g.A, X: g.X, Y: g.Y, I: g.I}
+		if !cmp.Equal(want, got) {
+			t.Errorf("%s: %s", op, cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestASSERTZ(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 1; DECA; ASSERTZ; INCA; HALT")
 	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestASSERTZFailureReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 1; ASSERTZ; INCA; HALT")
+	err := g.Run()
+	if !errors.Is(err, gmachine.ErrAssertionFailed) {
+		t.Fatalf("want ErrAssertionFailed, got %v", err)
+	}
+	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestSWAPW(t *testing.T) {
+	t.Parallel()
+	g := runWords(t,
+		gmachine.Word(gmachine.OpSETA), 0x01234567_89ABCDEF,
+		gmachine.Word(gmachine.OpSWAPW),
+		gmachine.Word(gmachine.OpHALT),
+	)
+	var want gmachine.Word = 0x89ABCDEF_01234567
+	if want != g.A {
+		t.Errorf("want %#x, got %#x", want, g.A)
+	}
+	g = runWords(t,
+		gmachine.Word(gmachine.OpSETA), 0x01234567_89ABCDEF,
+		gmachine.Word(gmachine.OpSWAPW),
+		gmachine.Word(gmachine.OpSWAPW),
+		gmachine.Word(gmachine.OpHALT),
+	)
+	want = 0x01234567_89ABCDEF
+	if want != g.A {
+		t.Errorf("want swapping twice to give %#x, got %#x", want, g.A)
+	}
+}
+
+func TestSTIMM(t *testing.T) {
+	t.Parallel()
+	// There is no plain load instruction, so read back with LDAI and I = 0.
+	g := AssembleAndRunFromString(t, "STIMM 100 42; LDAI 100; HALT")
+	var want gmachine.Word = 42
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	if want != g.Memory[100] {
+		t.Error(cmp.Diff(want, g.Memory[100]))
+	}
+}
+
+func TestSTIMMOutOfRangeReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "STIMM 5000 42; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for store outside memory, got nil")
+	}
+}
+
+func TestSUBA(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 3;MVAX;SETA 10;SUBA;halt")
+	var want gmachine.Word = 7
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSUBAWrapsAround(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 3;MVAX;SETA 2;SUBA;halt")
+	var want gmachine.Word = math.MaxUint64
 	got := g.A
 	if want != got {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestSETA(t *testing.T) {
+func TestLDAA(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, `
+SETA head
+// follow the pointer in the first node to the second
+LDAA
+MVAX
+LDAA
+HALT
+.data
+head:
+next
+next:
+42
+`)
+	var wantX gmachine.Word = 7
+	if wantX != g.X {
+		t.Errorf("want pointer to second node %d, got %d", wantX, g.X)
+	}
+	var want gmachine.Word = 42
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestLDAAOutOfRangeReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 5000; LDAA; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for load outside memory, got nil")
+	}
+}
+
+func TestCALLAndRET(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, `
+SETA 1
+CALL increment
+HALT
+increment:
+INCA
+RET
+`)
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 2
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	// P is left just past the HALT which follows the CALL.
+	var wantP gmachine.Word = 5
+	if wantP != g.P {
+		t.Errorf("want P %d after returning to the CALL site, got %d", wantP, g.P)
+	}
+}
+
+func TestRETWithoutCALLReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "RET")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for return with empty stack, got nil")
+	}
+}
+
+const unbalancedSubroutine = `
+CALL sub
+HALT
+sub:
+PUSHA
+RET
+`
+
+func TestCheckStackBalance(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, unbalancedSubroutine)
+	g.CheckStackBalance = true
+	err := g.Run()
+	if err == nil || !strings.Contains(err.Error(), "stack imbalance in subroutine") {
+		t.Errorf("want stack imbalance error, got %v", err)
+	}
+}
+
+func TestCheckStackBalanceOffByDefault(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, unbalancedSubroutine)
+	g.MaxCycles = 100
+	err := g.Run()
+	if err != nil && strings.Contains(err.Error(), "stack imbalance") {
+		t.Errorf("want no stack imbalance check by default, got %v", err)
+	}
+}
+
+func TestCheckStackBalanceAcceptsBalancedSubroutine(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "CALL sub; HALT; sub: PUSHA; POPA; RET")
+	g.CheckStackBalance = true
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOUTH(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 255; OUTH; HALT")
+	want := "0xff"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestOUTNUM(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 89; OUTNUM; HALT")
+	want := "89"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestOUTNUMWithOUTA(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 'n'; OUTA; SETA '='; OUTA; SETA 89; OUTNUM; HALT")
+	want := "n=89"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSETXAndSETY(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETX 10; SETY 20; ADXY; HALT")
+	var want gmachine.Word = 30
+	if want != g.Y {
+		t.Error(cmp.Diff(want, g.Y))
+	}
+	var wantX gmachine.Word = 10
+	if wantX != g.X {
+		t.Errorf("want X %d, got %d", wantX, g.X)
+	}
+	if g.A != 0 {
+		t.Errorf("want A untouched, got %d", g.A)
+	}
+}
+
+func TestMULAX(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 7; MVAX; SETA 6; MULAX; HALT")
+	var want gmachine.Word = 42
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestMULAXWrapsAround(t *testing.T) {
+	t.Parallel()
+	// 2^32 * 2^32 is 2^64, which wraps around to 0.
+	g := AssembleAndRunFromString(t, "SETA 4294967296; MVAX; MULAX; HALT")
+	var want gmachine.Word = 0
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestDIVAX(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; MVAX; SETA 17; DIVAX; HALT")
+	var want gmachine.Word = 3
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	var wantY gmachine.Word = 2
+	if wantY != g.Y {
+		t.Errorf("want remainder %d, got %d", wantY, g.Y)
+	}
+}
+
+func TestDIVAXByZeroReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 17; DIVAX; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Fatal("want error for division by zero, got nil")
+	}
+	want := "division by zero at P=2"
+	if want != err.Error() {
+		t.Errorf("want %q, got %q", want, err.Error())
+	}
+}
+
+func TestDJNZMatchesDECIAndJINZ(t *testing.T) {
+	t.Parallel()
+	slow := newGMachineFromProgram(t, "SETI 5; loop: INCA; DECI; JINZ loop; HALT")
+	slowSteps, err := slow.RunN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast := newGMachineFromProgram(t, "SETI 5; loop: INCA; DJNZ loop; HALT")
+	fastSteps, err := fast.RunN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 5
+	if want != slow.A || want != fast.A {
+		t.Errorf("want A %d from both loops, got %d with DECI and JINZ, %d with DJNZ", want, slow.A, fast.A)
+	}
+	// One instruction fewer for each of the five iterations.
+	if slowSteps-fastSteps != 5 {
+		t.Errorf("want DJNZ loop to take 5 fewer steps than %d, got %d", slowSteps, fastSteps)
+	}
+}
+
+func TestRAND(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "RAND; MVAX; RAND; HALT")
+	g.Rand = rand.New(rand.NewSource(42))
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gmachine.Word{0xafbf64b1967f8c53, 0x8872b44b9fbb971b}
+	got := []gmachine.Word{g.X, g.A}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestRANDIsReproducibleByDefault(t *testing.T) {
+	t.Parallel()
+	first := AssembleAndRunFromString(t, "RAND; HALT")
+	second := AssembleAndRunFromString(t, "RAND; HALT")
+	if first.A != second.A {
+		t.Errorf("want the same value from new machines, got %d and %d", first.A, second.A)
+	}
+}
+
+func TestJMPZJumpsWhenZIsSet(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; SETI 3; CMPI 3; JMPZ skip; DECA; skip: HALT")
+	var want gmachine.Word = 5
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestJMPZFallsThroughWhenZIsClear(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; SETI 3; CMPI 4; JMPZ skip; DECA; skip: HALT")
+	var want gmachine.Word = 4
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestJNEQFallsThroughWhenZIsSet(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; SETI 3; CMPI 3; JNEQ skip; DECA; skip: HALT")
+	var want gmachine.Word = 4
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestJMPRForward(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 5; JMPR +3; DECA; HALT")
+	var want gmachine.Word = 5
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestJMPRBackwardToLabel(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, `
+SETI 4
+loop:
+INCA
+DECI
+CMPI 0
+JMPZ end
+JMPR loop
+end:
+HALT
+`)
+	var want gmachine.Word = 4
+	if want != g.A {
+		t.Errorf("want loop body run %d times, got %d", want, g.A)
+	}
+}
+
+func TestJumpOutOfMemoryReturnsError(t *testing.T) {
+	t.Parallel()
+	for _, program := range []string{"JMPR -100", "JUMP 5000"} {
+		g := newGMachineFromProgram(t, program)
+		g.Trace = true
+		err := g.Run()
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: want out of range error, got %v", program, err)
+		}
+	}
+}
+
+func TestArgumentOutOfMemoryReturnsError(t *testing.T) {
+	t.Parallel()
+	g := gmachine.NewWithMemory(2)
+	g.Memory[1] = gmachine.Word(gmachine.OpSETA)
+	g.P = 1
+	err := g.Run()
+	if err == nil || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("want out of range error, got %v", err)
+	}
+}
+
+func TestJMPRBackward(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, `
+SETI 3
+INCA
+DECI
+CMPI 0
+JMPZ end
+JMPR -6
+end:
+HALT
+`)
+	var want gmachine.Word = 3
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestSUBASetsN(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 3; MVAX; SETA 2; SUBA; HALT")
+	if !g.N {
+		t.Error("want N set for negative result")
+	}
+	g = AssembleAndRunFromString(t, "SETA 2; MVAX; SETA 3; SUBA; HALT")
+	if g.N {
+		t.Error("want N clear for positive result")
+	}
+}
+
+func TestJNBranchesOnLessThan(t *testing.T) {
+	t.Parallel()
+	// Sets Y to 1 if the first value is less than the second.
+	program := `
+SETA %d
+MVAX
+SETA %d
+SUBA
+JN less
+HALT
+less:
+SETA 1
+MVAY
+HALT
+`
+	for _, c := range []struct {
+		a, x  gmachine.Word
+		wantY gmachine.Word
+	}{
+		{a: 2, x: 3, wantY: 1},
+		{a: 3, x: 2, wantY: 0},
+		{a: 3, x: 3, wantY: 0},
+	} {
+		g := AssembleAndRunFromString(t, fmt.Sprintf(program, c.x, c.a))
+		if c.wantY != g.Y {
+			t.Errorf("%d < %d: want Y %d, got %d", c.a, c.x, c.wantY, g.Y)
+		}
+	}
+}
+
+func TestCMOVZMovesXToAWhenZIsSet(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 9; MVAX; SETA 1; SETI 3; CMPI 3; CMOVZ; HALT")
+	var want gmachine.Word = 9
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestCMOVZLeavesAWhenZIsClear(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 9; MVAX; SETA 1; SETI 3; CMPI 4; CMOVZ; HALT")
+	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestINA(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "INA; MVAX; INA; HALT")
+	g.In = strings.NewReader("AB")
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantX gmachine.Word = 'A'
+	if wantX != g.X {
+		t.Errorf("want first byte %d, got %d", wantX, g.X)
+	}
+	var want gmachine.Word = 'B'
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	if g.Z {
+		t.Error("want Z false after reading a byte")
+	}
+}
+
+func TestINAAtEOFSetsZ(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 7; INA; HALT")
+	g.In = strings.NewReader("")
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Z {
+		t.Error("want Z true at end of input")
+	}
+	var want gmachine.Word = 7
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestOnInput(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, `
+loop:
+INA
+JMPZ end
+OUTA
+JUMP loop
+end:
+HALT
+`)
+	input := []rune("héllo")
+	g.OnInput = func() (rune, bool) {
+		if len(input) == 0 {
+			return 0, false
+		}
+		r := input[0]
+		input = input[1:]
+		return r, true
+	}
+	g.In = iotest.ErrReader(errors.New("In should not be read"))
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "héllo"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	if !g.Z {
+		t.Error("want Z true at end of input")
+	}
+}
+
+func TestSTAI(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, `
+SETI 2
+SETA 42
+STAI buffer
+SETA 0
+LDAI buffer
+HALT
+.data
+buffer:
+0
+0
+0
+`)
+	var want gmachine.Word = 42
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestSTAIOutOfRangeReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETI 5000; STAI 0; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for store outside memory, got nil")
+	}
+}
+
+func TestSTAX(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, `
+// point X at the second word of the buffer
+SETA buffer
+INCA
+MVAX
+SETA 42
+STAX
+SETA buffer
+INCA
+LDAA
+HALT
+.data
+buffer:
+0
+0
+`)
+	var want gmachine.Word = 42
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	if want != g.Memory[g.X] {
+		t.Errorf("want %d stored at %d, got %d", want, g.X, g.Memory[g.X])
+	}
+}
+
+func TestSTAXOutOfRangeReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 5000; MVAX; STAX; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for store outside memory, got nil")
+	}
+}
+
+func TestPUSHAAndPOPAAreLIFO(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "SETA 1; PUSHA; SETA 2; PUSHA; POPA; MVAX; POPA; HALT")
+	var wantX gmachine.Word = 2
+	if wantX != g.X {
+		t.Errorf("want last value pushed %d popped first, got %d", wantX, g.X)
+	}
+	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+	wantSP := gmachine.Word(gmachine.DefaultMemSize - 1)
+	if wantSP != g.SP {
+		t.Errorf("want SP back at %d, got %d", wantSP, g.SP)
+	}
+}
+
+func TestPUSHAIntoProgramReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "loop: PUSHA; JUMP loop")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for stack overflow, got nil")
+	}
+}
+
+func TestPOPAOnEmptyStackReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "POPA; HALT")
+	err := g.Run()
+	if err == nil {
+		t.Error("want error for stack underflow, got nil")
+	}
+}
+
+func TestSubtract2From3Gives1(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/subtract2from3.g")
+	var want gmachine.Word = 1
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSETA(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/setaTo5.g")
+	var want gmachine.Word = 5
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	var wantP gmachine.Word = 3
+	gotP := g.P
+	if wantP != gotP {
+		t.Error(cmp.Diff(wantP, gotP))
+	}
+}
+
+func TestFib(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/fib.g")
+	var want gmachine.Word = 89
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMixedBases(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/mixed_bases.g")
+	var want gmachine.Word = 120
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestAssembleAndRunFromReader(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromReader("stream.g", strings.NewReader("NOOP; INCA; halt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestAssembleAndRunFromReaderSetsLabels(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromReader("stream.g", strings.NewReader("JUMP end; end: HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[gmachine.Word]string{2: "end"}
+	if !cmp.Equal(want, g.Labels) {
+		t.Error(cmp.Diff(want, g.Labels))
+	}
+}
+
+func TestAssembleAndRunFromReaderErrorIncludesName(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromReader("stream.g", strings.NewReader("NOOP\n.cosnt"))
+	if err == nil {
+		t.Fatal("want syntax error, got nil")
+	}
+	wantPrefix := "stream.g:2:"
+	if !strings.HasPrefix(err.Error(), wantPrefix) {
+		t.Errorf("want prefix %q, got %q", wantPrefix, err.Error())
+	}
+}
+
+func TestMachineAssembleAndRunFromString(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromString("SETA 5; INCA; HALT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 6
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestMachineAssembleAndRunFromStringReturnsAssemblyError(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromString("NOOP\nJUMP nowhere")
+	if err == nil {
+		t.Fatal("want error for undefined label, got nil")
+	}
+	wantPrefix := "2:"
+	if !strings.HasPrefix(err.Error(), wantPrefix) {
+		t.Errorf("want prefix %q, got %q", wantPrefix, err.Error())
+	}
+}
+
+func TestMachineAssembleAndRunFromFile(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromFile("testdata/setaTo5.g", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 5
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestMachineAssembleAndRunFromFileReturnsAssemblyError(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.AssembleAndRunFromFile("testdata/syntax_error_line_2.g", false)
+	if err == nil {
+		t.Fatal("want syntax error, got nil")
+	}
+	wantPrefix := "testdata/syntax_error_line_2.g:2:"
+	if !strings.HasPrefix(err.Error(), wantPrefix) {
+		t.Errorf("want prefix %q, got %q", wantPrefix, err.Error())
+	}
+}
+
+func TestUnknownOpCodeReturnsError(t *testing.T) {
+	t.Parallel()
+	m := gmachine.New()
+	m.P = math.MaxUint64
+	err := m.Load([]gmachine.Word{math.MaxUint64})
+	if err != nil {
+		t.Error(err)
+	}
+	err = m.Run()
+	if err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestLoadFirmware(t *testing.T) {
+	t.Parallel()
+	firmware, err := gmachine.Assemble(strings.NewReader("SETI 5; JUMP 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := gmachine.Assemble(strings.NewReader("INCI; HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, load := range map[string]func(g *gmachine.Machine) error{
+		"firmware first": func(g *gmachine.Machine) error {
+			err := g.LoadFirmware(firmware)
+			if err != nil {
+				return err
+			}
+			return g.Load(program)
+		},
+		"program first": func(g *gmachine.Machine) error {
+			err := g.Load(program)
+			if err != nil {
+				return err
+			}
+			return g.LoadFirmware(firmware)
+		},
+	} {
+		g := gmachine.New()
+		err := load(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = g.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want gmachine.Word = 6
+		if want != g.I {
+			t.Errorf("%s: want I %d, got %d", name, want, g.I)
+		}
+	}
+}
+
+func TestLoadRejectsProgramOverlappingFirmware(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.LoadFirmware([]gmachine.Word{gmachine.Word(gmachine.OpJUMP), 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Load(make([]gmachine.Word, gmachine.DefaultMemSize-1))
+	if err == nil {
+		t.Error("want error loading a program overlapping the firmware, got nil")
+	}
+}
+
+func TestEvalRejectsSnippetReachingStack(t *testing.T) {
+	t.Parallel()
+	g := gmachine.NewWithMemory(8)
+	g.SP = 3
+	g.Memory[4] = 99
+	err := g.Eval("INCA; INCA; INCA; INCA")
+	if err == nil {
+		t.Fatal("want error for snippet reaching the stack, got nil")
+	}
+	var want gmachine.Word = 99
+	if want != g.Memory[4] {
+		t.Errorf("want stack word %d left intact, got %d", want, g.Memory[4])
+	}
+}
+
+func TestLoadFirmwareRejectsOverlappingProgram(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 5; HALT")
+	err := g.LoadFirmware(make([]gmachine.Word, gmachine.DefaultMemSize-2))
+	if err == nil {
+		t.Fatal("want error loading firmware overlapping the program, got nil")
+	}
+	want := []gmachine.Word{gmachine.Word(gmachine.OpSETA), 5, gmachine.Word(gmachine.OpHALT)}
+	got := g.Memory[:3]
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestEval(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	err := g.Eval("SETA 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Eval("INCA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 6
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestEvalWithLabelsKeepsProgram(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "INCA; HALT")
+	err := g.Eval("SETI 3; loop: INCA; DECI; JINZ loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantP gmachine.Word = 0
+	if wantP != g.P {
+		t.Errorf("want P restored to %d, got %d", wantP, g.P)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 4
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestNewWithMemoryLoadsLargeProgram(t *testing.T) {
+	t.Parallel()
+	g := gmachine.NewWithMemory(4096)
+	if len(g.Memory) != 4096 {
+		t.Fatalf("want 4096 words of memory, got %d", len(g.Memory))
+	}
+	program := make([]gmachine.Word, 2000)
+	for i := range program {
+		program[i] = gmachine.Word(gmachine.OpINCA)
+	}
+	program[len(program)-1] = gmachine.Word(gmachine.OpHALT)
+	err := g.Load(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 1999
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestNewWithMemoryPanicsForNonPositiveSize(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic for zero memory size")
+		}
+	}()
+	gmachine.NewWithMemory(0)
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 7; MVAX; MVAY; SETI 3; CMPI 3; PUSHA; OUTA; HALT")
+	out := g.Out
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Reset()
+	if g.A != 0 || g.I != 0 || g.P != 0 || g.X != 0 || g.Y != 0 || g.Z {
+		t.Errorf("want registers zeroed, got %v", g)
+	}
+	wantSP := gmachine.Word(len(g.Memory) - 1)
+	if wantSP != g.SP {
+		t.Errorf("want SP reset to %d, got %d", wantSP, g.SP)
+	}
+	want := make([]gmachine.Word, gmachine.DefaultMemSize)
+	if !cmp.Equal(want, g.Memory) {
+		t.Error("want memory zeroed")
+	}
+	if out != g.Out {
+		t.Error("want Out unchanged")
+	}
+}
+
+func TestResetReseedsRand(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "RAND; HALT")
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Reset()
+	want := gmachine.New().Rand.Uint64()
+	got := g.Rand.Uint64()
+	if want != got {
+		t.Errorf("want the same random value as a new machine, %d, got %d", want, got)
+	}
+}
+
+func TestLoadWarmKeepsP(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	g.P = 2
+	err := g.LoadWarm([]gmachine.Word{
+		gmachine.Word(gmachine.OpINCA),
+		gmachine.Word(gmachine.OpINCA),
+		gmachine.Word(gmachine.OpINCA),
+		gmachine.Word(gmachine.OpHALT),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantP gmachine.Word = 2
+	if wantP != g.P {
+		t.Fatalf("want P %d after warm load, got %d", wantP, g.P)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 1
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestPrintA(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/print_char.g")
+	want := "A"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPrintHelloWorld(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromFile(t, "testdata/hello_world.g")
+	want := "Hello World"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// opSQRA is an opcode outside the standard instruction set, used to test
+// custom decoders.
+const opSQRA gmachine.OpCode = 1000
+
+// squareDecoder adds the SQRA instruction, which squares A, to the standard
+// instruction set.
+type squareDecoder struct{}
+
+func (squareDecoder) Execute(g *gmachine.Machine, op gmachine.OpCode) (bool, error) {
+	if op == opSQRA {
+		g.A *= g.A
+		return false, nil
+	}
+	return gmachine.DefaultDecoder{}.Execute(g, op)
+}
+
+func TestCustomDecoder(t *testing.T) {
+	t.Parallel()
+	g := gmachine.New()
+	g.Decoder = squareDecoder{}
+	err := g.Load([]gmachine.Word{
+		gmachine.Word(gmachine.OpSETA), 7,
+		gmachine.Word(opSQRA),
+		gmachine.Word(gmachine.OpINCA),
+		gmachine.Word(gmachine.OpHALT),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 50
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestMemTrace(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "JUMP main; 10; 20; main: SETI 1; LDAI 2; DECI; LDAI 2; HALT")
+	trace := new(bytes.Buffer)
+	g.MemTrace = trace
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "read 3 20\nread 2 10\n"
+	got := trace.String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTrace(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "inca inca halt")
+	out := new(bytes.Buffer)
+	g.Out = out
+	g.Trace = true
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "000000: INCA A: 000001\n" +
+		"000001: INCA A: 000002\n" +
+		"000002: HALT A: 000002\n"
+	got := out.String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestOnOutput(t *testing.T) {
 	t.Parallel()
-	g := AssembleAndRunFromFile(t, "testdata/setaTo5.g")
-	var want gmachine.Word = 5
-	got := g.A
+	program, err := os.ReadFile("testdata/hello_world.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGMachineFromProgram(t, string(program))
+	var runes []rune
+	g.OnOutput = func(r rune) {
+		runes = append(runes, r)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Hello World"
+	got := string(runes)
 	if want != got {
-		t.Error(cmp.Diff(want, got))
+		t.Errorf("want %q, got %q", want, got)
 	}
-	var wantP gmachine.Word = 3
-	gotP := g.P
-	if wantP != gotP {
-		t.Error(cmp.Diff(wantP, gotP))
+	if out := g.Out.(*bytes.Buffer).String(); out != "" {
+		t.Errorf("want no output written to Out, got %q", out)
 	}
 }
 
-func TestFib(t *testing.T) {
+func TestRunContextStopsWhenContextIsDone(t *testing.T) {
 	t.Parallel()
-	g := AssembleAndRunFromFile(t, "testdata/fib.g")
-	var want gmachine.Word = 89
-	got := g.A
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	g := newGMachineFromProgram(t, "loop: JUMP loop")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := g.RunContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
 	}
 }
 
-func TestAssembleAndRunFromReader(t *testing.T) {
+func TestRunNCountsSteps(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "inca inca halt")
+	steps, err := g.RunN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want uint64 = 3
+	if want != steps {
+		t.Error(cmp.Diff(want, steps))
+	}
+}
+
+func TestMaxCycles(t *testing.T) {
 	t.Parallel()
-	AssembleAndRunFromString(t, "NOOP; halt")
+	g := newGMachineFromProgram(t, "JUMP 0")
+	g.MaxCycles = 100
+	err := g.Run()
+	if !errors.Is(err, gmachine.ErrMaxCycles) {
+		t.Fatalf("want ErrMaxCycles, got %v", err)
+	}
 }
 
-func TestUnknownOpCodeReturnsError(t *testing.T) {
+func TestMaxWrites(t *testing.T) {
 	t.Parallel()
-	m := gmachine.New()
-	m.P = math.MaxUint64
-	err := m.Load([]gmachine.Word{math.MaxUint64})
-	if err != nil {
-		t.Error(err)
+	g := newGMachineFromProgram(t, "SETI 0; loop: INCA; STAI 100; INCI; JUMP loop")
+	g.MaxWrites = 5
+	err := g.Run()
+	if !errors.Is(err, gmachine.ErrMaxWrites) {
+		t.Fatalf("want ErrMaxWrites, got %v", err)
 	}
-	err = m.Run()
+	if !strings.Contains(err.Error(), "write limit exceeded") {
+		t.Errorf("want write limit exceeded error, got %v", err)
+	}
+	// The five stores allowed were made before the sixth failed.
+	want := []gmachine.Word{1, 2, 3, 4, 5, 0}
+	got := g.Memory[100:106]
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	t.Parallel()
+	for program, wantErr := range map[string]string{
+		"JMPR -100":          "out of range",
+		"SETX 5000; STAX":    "out of range",
+		"loop: JUMP loop":    "exceeded max cycles",
+		unbalancedSubroutine: "stack imbalance in subroutine",
+	} {
+		g := newGMachineFromProgram(t, program)
+		// SafeMode keeps a smaller limit, which makes the endless loop
+		// quick to stop.
+		g.MaxCycles = 1000
+		g.SafeMode()
+		err := g.Run()
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%q: want error containing %q, got %v", program, wantErr, err)
+		}
+	}
+}
+
+func TestBareModeOutOfBoundsReturnsError(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "JMPR -100")
+	err := g.Run()
 	if err == nil {
-		t.Error("no error")
+		t.Error("want error for jump outside memory without SafeMode, got nil")
 	}
 }
 
-func TestPrintA(t *testing.T) {
+func TestMaxCyclesAllowsProgramToHalt(t *testing.T) {
 	t.Parallel()
-	g := AssembleAndRunFromFile(t, "testdata/print_char.g")
-	want := "A"
-	got := g.Out.(*bytes.Buffer).String()
-	if want != got {
-		t.Errorf("want %q, got %q", want, got)
+	g := newGMachineFromProgram(t, "INCA; INCA; HALT")
+	g.MaxCycles = 3
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestPrintHelloWorld(t *testing.T) {
+func TestRunUntilOutput(t *testing.T) {
 	t.Parallel()
-	g := AssembleAndRunFromFile(t, "testdata/hello_world.g")
-	want := "Hello World"
+	g := newGMachineFromProgram(t, `
+SETA 'r'; OUTA
+SETA 'e'; OUTA
+SETA 'a'; OUTA
+SETA 'd'; OUTA
+SETA 'y'; OUTA
+wait:
+JUMP wait
+`)
+	err := g.RunUntilOutput("ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ready"
 	got := g.Out.(*bytes.Buffer).String()
 	if want != got {
 		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
+func TestRunUntilOutputStopsOnHalt(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 'A'; OUTA; HALT")
+	err := g.RunUntilOutput("ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantP gmachine.Word = 4
+	if wantP != g.P {
+		t.Errorf("want P %d after halting, got %d", wantP, g.P)
+	}
+}
+
+func TestRunUntilOutputRespectsMaxCycles(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "loop: JUMP loop")
+	g.MaxCycles = 100
+	err := g.RunUntilOutput("ready")
+	if !errors.Is(err, gmachine.ErrMaxCycles) {
+		t.Errorf("want ErrMaxCycles, got %v", err)
+	}
+}
+
+func TestRunUntilOutputMatchesOnOutput(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETA 'o'; OUTA; SETA 'k'; OUTA; wait: JUMP wait")
+	var got []rune
+	g.OnOutput = func(r rune) { got = append(got, r) }
+	g.MaxCycles = 100
+	err := g.RunUntilOutput("ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rune("ok")
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestOpCode_RequiresArgument(t *testing.T) {
 	t.Parallel()
-	for _, c := range []gmachine.OpCode{gmachine.OpSETA, gmachine.OpSETI} {
+	for _, c := range []gmachine.OpCode{gmachine.OpSETA, gmachine.OpSETI, gmachine.OpJINZ, gmachine.OpLDAI, gmachine.OpCMPI, gmachine.OpDJNZ} {
 		if !c.RequiresArgument() {
 			t.Errorf("Op code %s should require argument", c.String())
 		}
@@ -168,7 +1663,7 @@ func TestOpCode_RequiresArgument(t *testing.T) {
 func TestStateStringOutput(t *testing.T) {
 	t.Parallel()
 	g := AssembleAndRunFromString(t, "inca halt inca")
-	want := "P: 000002 A: 000001 I: 000000 X: 000000 Y: 000000 Z: false NEXT: INCA"
+	want := "P: 000002 A: 000001 I: 000000 X: 000000 Y: 000000 Z: false N: false NEXT: INCA"
 	got := g.String()
 	if want != got {
 		t.Error(cmp.Diff(want, got))
@@ -187,6 +1682,167 @@ func TestDebugFlag(t *testing.T) {
 	}
 }
 
+func TestDebugSetRegister(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "inca halt")
+	g.In = strings.NewReader("set A 10\nc\n")
+	g.Debug = true
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 11
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDebugSetMemory(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "ldai 20 halt")
+	g.In = strings.NewReader("set mem 20 99\nc\n")
+	g.Debug = true
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want gmachine.Word = 99
+	got := g.A
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDumpMemory(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, `
+HALT
+.data
+table:
+.word 1 2 3 4 5 6 7 8 9 10
+`)
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "000001: 000001 000002 000003 000004 000005 000006 000007 000008\n" +
+		"000009: 000009 000010\n"
+	got := g.DumpMemory(1, 11)
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDumpMemoryClampsRange(t *testing.T) {
+	t.Parallel()
+	g := gmachine.NewWithMemory(4)
+	g.Memory[3] = 42
+	want := "000002: 000000 000042\n"
+	got := g.DumpMemory(2, 100)
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	if got := g.DumpMemory(3, 1); got != "" {
+		t.Errorf("want empty dump when start is after end, got %q", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "STIMM 100 7; STIMM 101 8; STIMM 100 9; HALT")
+	g.In = strings.NewReader("c\nc\n")
+	g.Memory[100] = 5
+	g.Watch(100)
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := g.Out.(*bytes.Buffer).String()
+	for _, want := range []string{"watch 100: 5 -> 7\n", "watch 100: 7 -> 9\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in output %q", want, got)
+		}
+	}
+	if strings.Contains(got, "watch 101") {
+		t.Errorf("want no watch for unwatched address in output %q", got)
+	}
+	if strings.Count(got, "P:") != 2 {
+		t.Errorf("want a pause after each change in output %q", got)
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "SETI 10; loop: INCA; DECI; JINZ loop; HALT")
+	g.Profiling = true
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for op, want := range map[gmachine.OpCode]uint64{
+		gmachine.OpSETI: 1,
+		gmachine.OpINCA: 10,
+		gmachine.OpDECI: 10,
+		gmachine.OpJINZ: 10,
+		gmachine.OpHALT: 1,
+	} {
+		if want != g.Profile[op] {
+			t.Errorf("%s: want %d executions, got %d", op, want, g.Profile[op])
+		}
+	}
+	want := "OPCODE  COUNT\n" +
+		"INCA    10\n" +
+		"DECI    10\n" +
+		"JINZ    10\n" +
+		"HALT    1\n" +
+		"SETI    1\n"
+	got := g.ProfileReport()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestProfilingOffByDefault(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "INCA; HALT")
+	if g.Profile != nil {
+		t.Errorf("want no profile without Profiling, got %v", g.Profile)
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "INCA; INCA; INCA; HALT")
+	g.In = strings.NewReader("c\n")
+	g.AddBreakpoint(2)
+	err := g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := g.Out.(*bytes.Buffer).String()
+	if strings.Count(got, "P:") != 1 {
+		t.Fatalf("want state printed once, got %q", got)
+	}
+	if !strings.HasPrefix(got, "P: 000002 A: 000002") {
+		t.Errorf("want state printed at the breakpoint, got %q", got)
+	}
+	var want gmachine.Word = 3
+	if want != g.A {
+		t.Error(cmp.Diff(want, g.A))
+	}
+}
+
+func TestDBG(t *testing.T) {
+	t.Parallel()
+	g := AssembleAndRunFromString(t, "inca dbg halt")
+	want := "P: 000002 A: 000001 I: 000000 X: 000000 Y: 000000 Z: false N: false NEXT: HALT\n"
+	got := g.Out.(*bytes.Buffer).String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestDebugger_DecodeInstruction(t *testing.T) {
 	t.Parallel()
 	want := "JUMP 5"
@@ -198,6 +1854,42 @@ func TestDebugger_DecodeInstruction(t *testing.T) {
 	}
 }
 
+func TestDecodeInstructionWithTwoArguments(t *testing.T) {
+	t.Parallel()
+	want := "STIMM 100 42"
+	g := gmachine.New()
+	copy(g.Memory, []gmachine.Word{gmachine.Word(gmachine.OpSTIMM), 100, 42})
+	got := g.DecodeNextInstruction()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDecodeInstructionWithLabels(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader("JUMP main; SETA 4; main: HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := gmachine.New()
+	err = g.LoadProgram(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "JUMP main"
+	got := g.DecodeNextInstruction()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+	// SETA 4 loads a value rather than jumping, so 4 is not shown as main.
+	g.P = 2
+	want = "SETA 4"
+	got = g.DecodeNextInstruction()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestInvertMap(t *testing.T) {
 	t.Parallel()
 	testMap := map[string]int{"A": 1, "B": 2, "C": 3}
@@ -209,16 +1901,83 @@ func TestInvertMap(t *testing.T) {
 	}
 }
 
+func TestSelfTest(t *testing.T) {
+	t.Parallel()
+	err := gmachine.SelfTest()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadProgramPrefersSmallestLabelAtAddress(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader("JUMP start; end: begin: start: HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		g := gmachine.New()
+		err = g.LoadProgram(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "JUMP begin"
+		got := g.DecodeNextInstruction()
+		if want != got {
+			t.Fatal(cmp.Diff(want, got))
+		}
+	}
+}
+
+// invalidPrograms lists the programs in testdata which are meant not to
+// assemble.
+var invalidPrograms = map[string]bool{
+	"assembly_error.g":      true,
+	"invalid_program.g":     true,
+	"syntax_error_column.g": true,
+	"syntax_error.g":        true,
+	"syntax_error_line_2.g": true,
+}
+
+func TestTestdataProgramsAssemble(t *testing.T) {
+	t.Parallel()
+	filenames, err := filepath.Glob("testdata/*.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filenames) == 0 {
+		t.Fatal("no programs found in testdata")
+	}
+	for _, filename := range filenames {
+		if invalidPrograms[filepath.Base(filename)] {
+			continue
+		}
+		_, err := gmachine.AssembleFromFile(filename)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 func TestScript(t *testing.T) {
 	t.Parallel()
+	testdata, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
 	testscript.Run(t, testscript.Params{
 		Dir: "testdata/scripts",
+		Setup: func(env *testscript.Env) error {
+			env.Setenv("TESTDATA", testdata)
+			return nil
+		},
 	})
 }
 
 func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(m, map[string]func() int{
 		"run": gmachine.MainRun,
+		"asm": gmachine.MainAsm,
 	}))
 }
 
@@ -237,6 +1996,27 @@ func newGMachineFromProgram(t *testing.T, program string) *gmachine.Machine {
 	return g
 }
 
+// runWords loads the given words into a new machine and runs it.
+func runWords(t *testing.T, words ...gmachine.Word) *gmachine.Machine {
+	t.Helper()
+	g := gmachine.New()
+	g.Out = new(bytes.Buffer)
+	err := g.Load(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// negative returns the two's complement representation of -n.
+func negative(n gmachine.Word) gmachine.Word {
+	return -n
+}
+
 func AssembleAndRunFromFile(t *testing.T, filename string) *gmachine.Machine {
 	t.Helper()
 
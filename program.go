@@ -0,0 +1,235 @@
+package gmachine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Program is an assembled G-machine program together with the addresses of
+// the labels defined in its source.
+type Program struct {
+	Words  []Word
+	Labels map[string]Word
+
+	// CodeSize is the number of words at the start of Words which were
+	// assembled from the .text section. The rest come from .data.
+	CodeSize int
+
+	// inlineData is the number of words in the .text section which were
+	// emitted by .word directives rather than assembled from instructions.
+	inlineData int
+
+	// Warnings describes problems found in the source which did not
+	// prevent it from being assembled, such as labels which are never
+	// referenced.
+	Warnings []string
+
+	// Stats describes the work done by the assembler.
+	Stats AssemblyStats
+}
+
+// AssemblyStats records how much work went into assembling a program.
+type AssemblyStats struct {
+	// Tokens is the number of tokens read from the source, including
+	// comments.
+	Tokens int
+	// Words is the number of words in the assembled program.
+	Words int
+	// Duration is the time taken to tokenize and assemble the source,
+	// not counting reading it.
+	Duration time.Duration
+}
+
+// Size returns the number of words of code and of data in the program, and
+// their total. Words emitted by .word count as data even in the .text section.
+func (p Program) Size() (code, data, total int) {
+	code = p.CodeSize - p.inlineData
+	return code, len(p.Words) - code, len(p.Words)
+}
+
+// CFG returns a Graphviz DOT description of the program's control-flow
+// graph. Each node is a basic block of instructions and each edge is either a
+// jump or a fall through from one block into the next.
+func (p Program) CFG() string {
+	var starts []int
+	leaders := map[int]bool{0: true}
+	for addr := 0; addr < len(p.Words); {
+		starts = append(starts, addr)
+		op := OpCode(p.Words[addr])
+		next := addr + op.size()
+		if target, ok := p.jumpTarget(addr); ok {
+			leaders[target] = true
+		}
+		if op.isJump() || op == OpJMPR || op == OpHALT || op == OpRET {
+			leaders[next] = true
+		}
+		addr = next
+	}
+
+	var blocks [][]int
+	for _, addr := range starts {
+		if leaders[addr] || len(blocks) == 0 {
+			blocks = append(blocks, nil)
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], addr)
+	}
+	isBlock := map[int]bool{}
+	for _, block := range blocks {
+		isBlock[block[0]] = true
+	}
+
+	names := map[int]string{}
+	for label, addr := range p.Labels {
+		names[int(addr)] = label
+	}
+
+	b := new(strings.Builder)
+	fmt.Fprintln(b, "digraph cfg {")
+	for i, block := range blocks {
+		var lines []string
+		if name, ok := names[block[0]]; ok {
+			lines = append(lines, name+":")
+		}
+		for _, addr := range block {
+			lines = append(lines, fmt.Sprintf("%d: %s", addr, p.decode(addr)))
+		}
+		fmt.Fprintf(b, "\tb%d [shape=box label=%q];\n", block[0], strings.Join(lines, "\n"))
+
+		last := block[len(block)-1]
+		op := OpCode(p.Words[last])
+		var targets []int
+		if target, ok := p.jumpTarget(last); ok {
+			targets = append(targets, target)
+		}
+		if op != OpHALT && op != OpJUMP && op != OpJMPR && op != OpRET && i+1 < len(blocks) {
+			targets = append(targets, blocks[i+1][0])
+		}
+		sort.Ints(targets)
+		for j, target := range targets {
+			if !isBlock[target] || (j > 0 && targets[j-1] == target) {
+				continue
+			}
+			fmt.Fprintf(b, "\tb%d -> b%d;\n", block[0], target)
+		}
+	}
+	fmt.Fprintln(b, "}")
+	return b.String()
+}
+
+// Reachability reports, for each instruction address in the program,
+// whether control can reach it from address 0. It follows jumps and both
+// outcomes of conditional jumps, without regard to register values, so an
+// address reported as unreachable is dead code. The instruction addresses
+// are those found by decoding the program from the start; any other address
+// which a jump can reach is also included.
+func (p Program) Reachability() map[Word]bool {
+	result := map[Word]bool{}
+	for addr := 0; addr < len(p.Words); addr += OpCode(p.Words[addr]).size() {
+		result[Word(addr)] = false
+	}
+	work := []int{0}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if addr < 0 || addr >= len(p.Words) || result[Word(addr)] {
+			continue
+		}
+		result[Word(addr)] = true
+		work = append(work, p.successors(addr)...)
+	}
+	return result
+}
+
+// successors returns the addresses to which control may pass after
+// executing the instruction at addr.
+func (p Program) successors(addr int) []int {
+	op := OpCode(p.Words[addr])
+	// Where RET returns to depends on the stack, so like HALT it has no
+	// successors of its own; the instruction after each CALL is treated as
+	// reachable instead.
+	if op.String() == "" || op == OpHALT || op == OpRET {
+		return nil
+	}
+	next := addr + op.size()
+	if !op.isJump() && op != OpJMPR {
+		return []int{next}
+	}
+	target, ok := p.jumpTarget(addr)
+	if !ok {
+		return nil
+	}
+	if op == OpJUMP || op == OpJMPR {
+		return []int{target}
+	}
+	return []int{target, next}
+}
+
+// jumpTarget returns the address to which the jump at addr may transfer
+// control, and false if the instruction at addr is not a jump or is missing
+// its argument.
+func (p Program) jumpTarget(addr int) (int, bool) {
+	op := OpCode(p.Words[addr])
+	if addr+1 >= len(p.Words) {
+		return 0, false
+	}
+	switch {
+	case op == OpJMPR:
+		return addr + int(int64(p.Words[addr+1])), true
+	case op.isJump():
+		return int(p.Words[addr+1]), true
+	}
+	return 0, false
+}
+
+// RoundTrip assembles src and disassembles the result back into canonical
+// assembly text, with one instruction per line. Words which are not
+// instructions are written as number literals, and label references are
+// replaced by the addresses they resolved to, so assembling the result gives
+// the same words as assembling src.
+func RoundTrip(src string) (string, error) {
+	p, err := AssembleProgram(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	b := new(strings.Builder)
+	for addr := 0; addr < len(p.Words); addr += OpCode(p.Words[addr]).size() {
+		fmt.Fprintln(b, p.decode(addr))
+	}
+	return b.String(), nil
+}
+
+// Disassemble returns a listing of program with one instruction per line,
+// each preceded by its address, as in "0: SETA 5". Words which are not
+// opcodes, or which would be instructions but for the program ending before
+// their arguments, are listed as "??? value". Such words are often data, so
+// they are not treated as errors.
+func Disassemble(program []Word) (string, error) {
+	p := Program{Words: program}
+	b := new(strings.Builder)
+	for addr := 0; addr < len(program); {
+		op := OpCode(program[addr])
+		if op.String() == "" || addr+op.ArgCount() >= len(program) {
+			fmt.Fprintf(b, "%d: ??? %d\n", addr, program[addr])
+			addr++
+			continue
+		}
+		fmt.Fprintf(b, "%d: %s\n", addr, p.decode(addr))
+		addr += op.size()
+	}
+	return b.String(), nil
+}
+
+// decode returns the assembly text of the instruction at addr.
+func (p Program) decode(addr int) string {
+	op := OpCode(p.Words[addr])
+	name := op.String()
+	if name == "" {
+		return fmt.Sprint(p.Words[addr])
+	}
+	for i := addr + 1; i <= addr+op.ArgCount() && i < len(p.Words); i++ {
+		name += fmt.Sprintf(" %v", p.Words[i])
+	}
+	return name
+}
@@ -0,0 +1,255 @@
+package gmachine_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCFG(t *testing.T) {
+	t.Parallel()
+	file, err := os.Open("testdata/fib.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	p, err := gmachine.AssembleProgram(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := p.CFG()
+	if !strings.HasPrefix(dot, "digraph") {
+		t.Errorf("want DOT digraph, got %q", dot)
+	}
+	wantNodes := 3
+	gotNodes := strings.Count(dot, "[shape=box")
+	if wantNodes != gotNodes {
+		t.Errorf("want %d nodes, got %d:\n%s", wantNodes, gotNodes, dot)
+	}
+	for _, edge := range []string{"b0 -> b3;", "b3 -> b3;", "b3 -> b10;"} {
+		if !strings.Contains(dot, edge) {
+			t.Errorf("want edge %q in:\n%s", edge, dot)
+		}
+	}
+	wantEdges := 3
+	gotEdges := strings.Count(dot, "->")
+	if wantEdges != gotEdges {
+		t.Errorf("want %d edges, got %d:\n%s", wantEdges, gotEdges, dot)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, filename := range []string{"testdata/subtract2from3.g", "testdata/fib.g"} {
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := gmachine.Assemble(strings.NewReader(string(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, err := gmachine.RoundTrip(string(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gmachine.Assemble(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("%s: reassembling %q: %v", filename, text, err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Errorf("%s: %s", filename, cmp.Diff(want, got))
+		}
+		again, err := gmachine.RoundTrip(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != again {
+			t.Errorf("%s: round trip is not stable: %s", filename, cmp.Diff(text, again))
+		}
+	}
+}
+
+func TestRoundTripCanonicalText(t *testing.T) {
+	t.Parallel()
+	want := "SETA 3\nDECA\nDECA\nHALT\n"
+	got, err := gmachine.RoundTrip("seta 3\ndeca; deca\n// done\nhalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSize(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader(`
+SETI 1
+LDAI table
+HALT
+.data
+table:
+10 20 30 40
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, data, total := p.Size()
+	if code != 5 || data != 4 || total != 9 {
+		t.Errorf("want code 5, data 4, total 9, got code %d, data %d, total %d", code, data, total)
+	}
+}
+
+func TestSizeCountsWordsInTextAsData(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader("LDAI msg; HALT; msg: .word 72 105"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, data, total := p.Size()
+	if code != 3 || data != 2 || total != 5 {
+		t.Errorf("want code 3, data 2, total 5, got code %d, data %d, total %d", code, data, total)
+	}
+}
+
+func TestAssemblyStats(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgramFromFile("testdata/hello_world.g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4 comments, 8 instructions, 5 arguments and 11 rune literals
+	wantTokens := 28
+	if wantTokens != p.Stats.Tokens {
+		t.Errorf("want %d tokens, got %d", wantTokens, p.Stats.Tokens)
+	}
+	wantWords := 24
+	if wantWords != p.Stats.Words {
+		t.Errorf("want %d words, got %d", wantWords, p.Stats.Words)
+	}
+	if p.Stats.Duration <= 0 {
+		t.Errorf("want positive assembly duration, got %v", p.Stats.Duration)
+	}
+}
+
+func TestReachability(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader(`
+SETI 2
+loop:
+DECI
+JINZ loop
+JUMP end
+INCA
+INCA
+end:
+HALT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[gmachine.Word]bool{
+		0: true,  // SETI 2
+		2: true,  // DECI
+		3: true,  // JINZ loop
+		5: true,  // JUMP end
+		7: false, // INCA
+		8: false, // INCA
+		9: true,  // HALT
+	}
+	got := p.Reachability()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestReachabilityFollowsJMPR(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader("JMPR +3; INCA; HALT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[gmachine.Word]bool{
+		0: true,  // JMPR +3
+		2: false, // INCA
+		3: true,  // HALT
+	}
+	got := p.Reachability()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestReachabilityFollowsCALL(t *testing.T) {
+	t.Parallel()
+	p, err := gmachine.AssembleProgram(strings.NewReader(`
+CALL sub
+HALT
+INCA
+sub:
+INCA
+RET
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[gmachine.Word]bool{
+		0: true,  // CALL sub
+		2: true,  // HALT
+		3: false, // INCA
+		4: true,  // INCA
+		5: true,  // RET
+	}
+	got := p.Reachability()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader("SETA 5 halt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gmachine.Disassemble(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0: SETA 5\n2: HALT\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDisassembleUnknownOpcode(t *testing.T) {
+	t.Parallel()
+	got, err := gmachine.Disassemble([]gmachine.Word{gmachine.Word(gmachine.OpNOOP), 9999, gmachine.Word(gmachine.OpHALT)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0: NOOP\n1: ??? 9999\n2: HALT\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestDisassembleTrailingDataWhichLooksLikeAnOpcode(t *testing.T) {
+	t.Parallel()
+	words, err := gmachine.Assemble(strings.NewReader("HALT; .data; 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gmachine.Disassemble(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0: HALT\n1: ??? 5\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
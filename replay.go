@@ -0,0 +1,144 @@
+package gmachine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kinds of event in an execution log written by RecordTo.
+const (
+	eventInput  byte = 'i'
+	eventEOF    byte = 'e'
+	eventRandom byte = 'r'
+)
+
+// RecordTo starts recording the machine's execution to w, so that it can be
+// reproduced with ReplayFrom. The current state is written first, followed,
+// as the machine runs, by everything it does which does not depend on that
+// state alone: each rune read by INA, the end of the input, and each value
+// loaded by RAND.
+func (g *Machine) RecordTo(w io.Writer) error {
+	state := g.SaveState()
+	err := binary.Write(w, binary.LittleEndian, uint64(len(state)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(state)
+	if err != nil {
+		return err
+	}
+	g.recorder = w
+	return nil
+}
+
+// ReplayFrom restores the state at the start of a log written by RecordTo and
+// runs the machine, taking input and random values from the log instead of
+// In, OnInput and Rand. Given the same program, it reaches the same final
+// state as the recorded run. An error is returned if the log is truncated or
+// does not match what the program asks for.
+func (g *Machine) ReplayFrom(r io.Reader) error {
+	var size uint64
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return errors.New("execution log is truncated")
+	}
+	state := make([]byte, size)
+	_, err = io.ReadFull(r, state)
+	if err != nil {
+		return errors.New("execution log is truncated")
+	}
+	err = g.RestoreState(state)
+	if err != nil {
+		return err
+	}
+	g.replay = r
+	defer func() { g.replay = nil }()
+	return g.Run()
+}
+
+// input returns the next rune of input for INA, and false at the end of the
+// input, recording or replaying it as required.
+func (g *Machine) input() (r rune, ok bool, err error) {
+	switch {
+	case g.replay != nil:
+		kind, err := g.replayEvent(eventInput, eventEOF)
+		if err != nil || kind == eventEOF {
+			return 0, false, err
+		}
+		var value uint32
+		err = binary.Read(g.replay, binary.LittleEndian, &value)
+		if err != nil {
+			return 0, false, errors.New("execution log is truncated")
+		}
+		return rune(value), true, nil
+	case g.OnInput != nil:
+		r, ok = g.OnInput()
+	default:
+		var b [1]byte
+		_, err := io.ReadFull(g.In, b[:])
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		r, ok = rune(b[0]), err == nil
+	}
+	if g.recorder != nil {
+		if !ok {
+			_, err = g.recorder.Write([]byte{eventEOF})
+		} else {
+			err = g.record(eventInput, uint32(r))
+		}
+	}
+	return r, ok, err
+}
+
+// random returns the next value for RAND, recording or replaying it as
+// required.
+func (g *Machine) random() (Word, error) {
+	if g.replay != nil {
+		_, err := g.replayEvent(eventRandom)
+		if err != nil {
+			return 0, err
+		}
+		var value Word
+		err = binary.Read(g.replay, binary.LittleEndian, &value)
+		if err != nil {
+			return 0, errors.New("execution log is truncated")
+		}
+		return value, nil
+	}
+	if g.Rand == nil {
+		g.Rand = newRand()
+	}
+	value := Word(g.Rand.Uint64())
+	if g.recorder != nil {
+		return value, g.record(eventRandom, value)
+	}
+	return value, nil
+}
+
+// record writes an event of the given kind, with its value, to the recorder.
+func (g *Machine) record(kind byte, value any) error {
+	_, err := g.recorder.Write([]byte{kind})
+	if err != nil {
+		return err
+	}
+	return binary.Write(g.recorder, binary.LittleEndian, value)
+}
+
+// replayEvent reads the kind of the next event from the log being replayed,
+// returning an error unless it is one of want.
+func (g *Machine) replayEvent(want ...byte) (byte, error) {
+	var kind [1]byte
+	_, err := io.ReadFull(g.replay, kind[:])
+	if err != nil {
+		return 0, errors.New("execution log is truncated")
+	}
+	for _, w := range want {
+		if kind[0] == w {
+			return w, nil
+		}
+	}
+	return 0, fmt.Errorf("execution log has event %q at P=%d, which the program does not match", kind[0], g.P)
+}
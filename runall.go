@@ -0,0 +1,40 @@
+package gmachine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// RunAll runs the machines concurrently, buffering the output of each, and
+// once they have all stopped writes their output to w in the order the
+// machines were given. Each machine's Out is restored when it has finished.
+// The returned error joins the errors from any machines which failed.
+func RunAll(w io.Writer, machines ...*Machine) error {
+	outputs := make([]bytes.Buffer, len(machines))
+	errs := make([]error, len(machines))
+	var wg sync.WaitGroup
+	for i, g := range machines {
+		wg.Add(1)
+		go func(i int, g *Machine) {
+			defer wg.Done()
+			out := g.Out
+			g.Out = &outputs[i]
+			defer func() { g.Out = out }()
+			err := g.Run()
+			if err != nil {
+				errs[i] = fmt.Errorf("machine %d: %w", i, err)
+			}
+		}(i, g)
+	}
+	wg.Wait()
+	for i := range outputs {
+		_, err := outputs[i].WriteTo(w)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
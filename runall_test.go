@@ -0,0 +1,60 @@
+package gmachine_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"github.com/google/go-cmp/cmp"
+)
+
+// printProgram returns the source of a program which prints s.
+func printProgram(s string) string {
+	b := new(strings.Builder)
+	for _, r := range s {
+		fmt.Fprintf(b, "SETA %d; OUTA\n", r)
+	}
+	b.WriteString("HALT\n")
+	return b.String()
+}
+
+func TestRunAllOutputInMachineOrder(t *testing.T) {
+	t.Parallel()
+	var machines []*gmachine.Machine
+	for _, s := range []string{"first ", "second ", "third"} {
+		machines = append(machines, newGMachineFromProgram(t, printProgram(s)))
+	}
+	out := new(bytes.Buffer)
+	err := gmachine.RunAll(out, machines...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "first second third"
+	got := out.String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestRunAllReportsErrors(t *testing.T) {
+	t.Parallel()
+	good := newGMachineFromProgram(t, printProgram("ok"))
+	bad := gmachine.New()
+	err := bad.Load([]gmachine.Word{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	err = gmachine.RunAll(out, good, bad)
+	if err == nil {
+		t.Fatal("want error from failing machine, got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "machine 1:") {
+		t.Errorf("want error for machine 1, got %q", err)
+	}
+	if out.String() != "ok" {
+		t.Errorf("want output %q, got %q", "ok", out.String())
+	}
+}
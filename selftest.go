@@ -0,0 +1,48 @@
+package gmachine
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// selfTestProgram counts A up from 60 in a loop of 12 iterations, takes one
+// off again and prints the result, which is the character 'G'.
+const selfTestProgram = `
+SETA 60
+SETI 12
+loop:
+INCA
+DECI
+JINZ loop
+DECA
+OUTA
+HALT
+`
+
+// SelfTest assembles and runs a small built-in program on a new machine,
+// returning an error if it fails to produce the expected result.
+func SelfTest() error {
+	program, err := Assemble(strings.NewReader(selfTestProgram))
+	if err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+	g := New()
+	out := new(bytes.Buffer)
+	g.Out = out
+	err = g.Load(program)
+	if err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+	err = g.Run()
+	if err != nil {
+		return fmt.Errorf("self test: %w", err)
+	}
+	if g.A != 'G' {
+		return fmt.Errorf("self test: want A %d, got %d", 'G', g.A)
+	}
+	if out.String() != "G" {
+		return fmt.Errorf("self test: want output %q, got %q", "G", out.String())
+	}
+	return nil
+}
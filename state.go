@@ -0,0 +1,89 @@
+package gmachine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// stateMagic identifies the output of SaveState.
+const stateMagic = "GMST"
+
+// stateVersion is the version of the format written by SaveState.
+const stateVersion byte = 3
+
+// machineState is the fixed-size part of a saved machine state, written in
+// little-endian byte order after the magic and version. The memory words
+// follow it.
+type machineState struct {
+	A, I, P, X, Y Word
+	SP            Word
+	Z, N          bool
+	FirmwareSize  uint64
+	ProgramSize   uint64
+	MemSize       uint64
+}
+
+// SaveState returns the registers, flags and memory of the machine encoded
+// in a versioned binary format which can be passed to RestoreState.
+func (g *Machine) SaveState() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(stateMagic)
+	buf.WriteByte(stateVersion)
+	state := machineState{
+		A:            g.A,
+		I:            g.I,
+		P:            g.P,
+		X:            g.X,
+		Y:            g.Y,
+		SP:           g.SP,
+		Z:            g.Z,
+		N:            g.N,
+		FirmwareSize: uint64(g.firmwareSize),
+		ProgramSize:  uint64(g.programSize),
+		MemSize:      uint64(len(g.Memory)),
+	}
+	// Writes to a bytes.Buffer cannot fail.
+	binary.Write(buf, binary.LittleEndian, state)
+	binary.Write(buf, binary.LittleEndian, g.Memory)
+	return buf.Bytes()
+}
+
+// RestoreState sets the registers, flags and memory of the machine from data
+// produced by SaveState.
+func (g *Machine) RestoreState(data []byte) error {
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(stateMagic))
+	r.Read(magic)
+	if string(magic) != stateMagic {
+		return errors.New("not a saved machine state")
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return errors.New("saved machine state is truncated")
+	}
+	if version != stateVersion {
+		return fmt.Errorf("unsupported saved machine state version %d", version)
+	}
+	var state machineState
+	err = binary.Read(r, binary.LittleEndian, &state)
+	if err != nil {
+		return errors.New("saved machine state is truncated")
+	}
+	if state.MemSize != uint64(r.Len()/8) || r.Len()%8 != 0 {
+		return errors.New("saved machine state has the wrong memory size")
+	}
+	if state.FirmwareSize > state.MemSize || state.ProgramSize > state.MemSize {
+		return errors.New("saved machine state has an invalid program or firmware size")
+	}
+	memory := make([]Word, state.MemSize)
+	binary.Read(r, binary.LittleEndian, memory)
+	g.Memory = memory
+	g.A, g.I, g.P, g.X, g.Y = state.A, state.I, state.P, state.X, state.Y
+	g.SP = state.SP
+	g.Z, g.N = state.Z, state.N
+	g.firmwareSize = int(state.FirmwareSize)
+	g.programSize = int(state.ProgramSize)
+	return nil
+}
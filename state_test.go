@@ -0,0 +1,131 @@
+package gmachine_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	gmachine "github.com/bit-gophers/merit-gmachine"
+	"github.com/google/go-cmp/cmp"
+)
+
+const countingProgram = `
+SETI 5
+loop:
+INCA
+DECI
+JINZ loop
+SETA 'x'
+OUTA
+SETI 3
+again:
+INCA
+DECI
+JINZ again
+HALT
+`
+
+func TestSaveAndRestoreState(t *testing.T) {
+	t.Parallel()
+	want := AssembleAndRunFromString(t, countingProgram)
+
+	g := newGMachineFromProgram(t, countingProgram)
+	err := g.RunUntilOutput("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := g.SaveState()
+	g.A = 999
+	g.I = 0
+	g.P = 0
+	g.Memory[0] = 0
+	err = g.RestoreState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want.Memory, g.Memory) {
+		t.Error(cmp.Diff(want.Memory, g.Memory))
+	}
+	if want.String() != g.String() {
+		t.Error(cmp.Diff(want.String(), g.String()))
+	}
+}
+
+func TestRestoreStateRejectsInvalidData(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "HALT")
+	state := g.SaveState()
+	for name, data := range map[string][]byte{
+		"empty":       nil,
+		"bad magic":   append([]byte("XXXX"), state[4:]...),
+		"bad version": append(append([]byte("GMST"), 99), state[5:]...),
+		"truncated":   state[:len(state)-3],
+	} {
+		err := g.RestoreState(data)
+		if err == nil {
+			t.Errorf("%s: want error, got nil", name)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+	const program = `
+INA
+MVAX
+INA
+MVAY
+RAND
+HALT
+`
+	g := newGMachineFromProgram(t, program)
+	g.In = strings.NewReader("hi")
+	g.Rand = rand.New(rand.NewSource(7))
+	log := new(bytes.Buffer)
+	err := g.RecordTo(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := gmachine.New()
+	replayed.In = iotest.ErrReader(errors.New("In should not be read"))
+	replayed.Rand = rand.New(rand.NewSource(8))
+	err = replayed.ReplayFrom(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(g.SaveState(), replayed.SaveState()) {
+		t.Errorf("want same final state from replay:\nrecorded: %v\nreplayed: %v", g, replayed)
+	}
+}
+
+func TestReplayFromTruncatedLog(t *testing.T) {
+	t.Parallel()
+	g := newGMachineFromProgram(t, "INA; HALT")
+	g.In = strings.NewReader("x")
+	log := new(bytes.Buffer)
+	err := g.RecordTo(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := log.Bytes()[:log.Len()-1]
+	err = gmachine.New().ReplayFrom(bytes.NewReader(truncated))
+	if err == nil {
+		t.Error("want error replaying a truncated log, got nil")
+	}
+}
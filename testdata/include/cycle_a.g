@@ -0,0 +1,2 @@
+#include "cycle_b.g"
+HALT
@@ -0,0 +1,4 @@
+// print writes A to the output.
+print:
+OUTA
+RET
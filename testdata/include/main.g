@@ -0,0 +1,8 @@
+// Prints "Hi" using a subroutine from another file.
+SETA 'H'
+CALL print
+SETA 'i'
+CALL print
+HALT
+
+#include "lib/print.g"
@@ -0,0 +1,14 @@
+// Decimal, hexadecimal and binary literals can be mixed freely, both as
+// immediate arguments and as the values of constants.
+.const MASK 0xFF
+.const FLAGS 0b1010
+SETA 0x1234 // 4660
+SETX MASK
+ANDAX       // 0x34 is 52
+SETX FLAGS
+ORAX        // 52 | 0b1010 is 62
+SETX 2
+MULAX       // 124
+SETX 0b100
+SUBA        // 120
+HALT
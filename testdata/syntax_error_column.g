@@ -0,0 +1,3 @@
+NOOP
+	SETA    0xG
+HALT